@@ -0,0 +1,95 @@
+package trek
+
+import (
+	"fmt"
+)
+
+// A Rename is an applied migration recorded under an alias of a migration,
+// the history entry is renamed from From to To before migrating
+type Rename struct {
+	From string
+	To   string
+}
+
+// AddAliases records previous names of migrations, so histories that applied
+// a migration under its old name keep treating it as applied. aliases maps
+// each old name to the current name of its migration.
+func AddAliases(migrations []Migration, aliases map[string]string) ([]Migration, error) {
+	index := make(map[string]int, len(migrations))
+	for i, m := range migrations {
+		index[m.Name] = i
+	}
+
+	out := append([]Migration(nil), migrations...)
+	for oldName, name := range aliases {
+		i, ok := index[name]
+		if !ok {
+			return nil, fmt.Errorf("alias %s refers to unknown migration %s", oldName, name)
+		}
+
+		if _, ok := index[oldName]; ok {
+			return nil, fmt.Errorf("alias %s of %s is the name of another migration", oldName, name)
+		}
+
+		out[i].Aliases = append(append([]string(nil), out[i].Aliases...), oldName)
+	}
+
+	return out, nil
+}
+
+// GetRenames returns every applied migration recorded under an alias of a
+// migration that has not been applied under its current name
+func GetRenames(migrations []Migration, applied []AppliedMigration) ([]Rename, error) {
+	appliedNames := make(map[string]bool, len(applied))
+	for _, a := range applied {
+		appliedNames[a.Name] = true
+	}
+
+	byAlias := make(map[string]string)
+	for _, m := range migrations {
+		for _, alias := range m.Aliases {
+			if other, ok := byAlias[alias]; ok && other != m.Name {
+				return nil, fmt.Errorf("migrations %s and %s share the alias %s", other, m.Name, alias)
+			}
+			byAlias[alias] = m.Name
+		}
+	}
+
+	var renames []Rename
+	renamed := make(map[string]string)
+	for _, a := range applied {
+		name, ok := byAlias[a.Name]
+		if !ok || appliedNames[name] {
+			continue
+		}
+
+		if from, ok := renamed[name]; ok {
+			return nil, fmt.Errorf("migration %s is recorded under both %s and %s", name, from, a.Name)
+		}
+		renamed[name] = a.Name
+
+		renames = append(renames, Rename{From: a.Name, To: name})
+	}
+
+	return renames, nil
+}
+
+// ApplyRenames returns applied with every renamed entry under its new name
+func ApplyRenames(applied []AppliedMigration, renames []Rename) []AppliedMigration {
+	to := make(map[string]string, len(renames))
+	for _, r := range renames {
+		to[r.From] = r.To
+	}
+
+	out := make([]AppliedMigration, 0, len(applied))
+	for _, a := range applied {
+		if name, ok := to[a.Name]; ok {
+			a.Name = name
+		}
+		out = append(out, a)
+	}
+
+	SortAppliedMigrations(out)
+
+	return out
+}
@@ -0,0 +1,97 @@
+package trek_test
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/fortytw2/trek"
+)
+
+func TestGetMigrationsRelativeNames(t *testing.T) {
+	fsys := fstest.MapFS{
+		"testdata/schema/01_init.up.sql":   {Data: []byte("SELECT 1;")},
+		"testdata/schema/01_init.down.sql": {Data: []byte("SELECT 2;")},
+		"testdata/schema/extra/02_x.sql":   {Data: []byte("SELECT 3;")},
+	}
+
+	migrations, err := trek.GetMigrationsIn(fsys, "testdata/schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) != 2 || migrations[0].Name != "01_init.sql" || migrations[1].Name != "extra/02_x.sql" {
+		t.Fatalf("unexpected migrations %+v", migrations)
+	}
+
+	if !reflect.DeepEqual(migrations[0].Aliases, []string{"testdata/schema/01_init.sql"}) {
+		t.Errorf("got aliases %v, want the full path", migrations[0].Aliases)
+	}
+}
+
+func TestGetMigrationsStableNames(t *testing.T) {
+	fsys := fstest.MapFS{
+		"schema/a/01_init.sql": {Data: []byte("SELECT 1;")},
+	}
+
+	before, err := trek.GetMigrationsIn(fsys, "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys["schema/b/02_x.sql"] = &fstest.MapFile{Data: []byte("SELECT 2;")}
+	after, err := trek.GetMigrationsIn(fsys, "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before[0].Name != "a/01_init.sql" || after[0].Name != before[0].Name {
+		t.Errorf("adding a migration renamed %s to %s", before[0].Name, after[0].Name)
+	}
+
+	all, err := trek.GetMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if all[0].Name != "schema/a/01_init.sql" {
+		t.Errorf("got %s, want the full path", all[0].Name)
+	}
+
+	_, err = trek.GetMigrationsIn(fsys, "missing")
+	if err == nil {
+		t.Error("got no error for a missing root")
+	}
+}
+
+func TestGetRenames(t *testing.T) {
+	migrations, err := trek.AddAliases([]trek.Migration{
+		{Name: "01_init.sql", Aliases: []string{"schema/01_init.sql"}},
+		{Name: "02_users.sql"},
+	}, map[string]string{"02_add_users.sql": "02_users.sql"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied := []trek.AppliedMigration{{Name: "02_add_users.sql"}, {Name: "schema/01_init.sql"}}
+
+	renames, err := trek.GetRenames(migrations, applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []trek.Rename{{From: "02_add_users.sql", To: "02_users.sql"}, {From: "schema/01_init.sql", To: "01_init.sql"}}
+	if !reflect.DeepEqual(renames, want) {
+		t.Errorf("got renames %v, want %v", renames, want)
+	}
+
+	renamed := trek.ApplyRenames(applied, renames)
+	if renamed[0].Name != "01_init.sql" || renamed[1].Name != "02_users.sql" {
+		t.Errorf("unexpected renamed history %+v", renamed)
+	}
+
+	_, err = trek.AddAliases(migrations, map[string]string{"old.sql": "missing.sql"})
+	if err == nil {
+		t.Error("expected an error for an alias of an unknown migration")
+	}
+}
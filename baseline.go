@@ -0,0 +1,62 @@
+package trek
+
+import (
+	"context"
+	"fmt"
+)
+
+// Baseline adopts an existing database whose schema was created without trek,
+// recording every migration up to and including upToName as applied without
+// running them. It takes the migration lock, failing with ErrMigrationLocked
+// if another instance holds it unless WaitForLock is given.
+func Baseline(db MigratableDB, allMigrations []Migration, upToName string, opts ...MigrateOption) error {
+	return BaselineContext(context.Background(), db, allMigrations, upToName, opts...)
+}
+
+// BaselineContext is Baseline with a context
+func BaselineContext(ctx context.Context, db MigratableDB, allMigrations []Migration, upToName string, opts ...MigrateOption) error {
+	o := newMigrateOptions(append([]MigrateOption{FailIfLocked()}, opts...))
+
+	allMigrations, err := prepareMigrations(allMigrations, o)
+	if err != nil {
+		return err
+	}
+
+	baseline, err := GetMigrationsUpTo(allMigrations, upToName)
+	if err != nil {
+		return err
+	}
+
+	return db.BaselineMigrations(ctx, baseline, o)
+}
+
+// GetMigrationsUpTo returns every versioned migration in the namespace of
+// name up to and including name
+func GetMigrationsUpTo(migrations []Migration, name string) ([]Migration, error) {
+	var namespace string
+	found := false
+	for _, m := range migrations {
+		if m.Name == name {
+			namespace = m.Namespace
+			found = true
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("%s is not a known migration", name)
+	}
+
+	var out []Migration
+	for _, m := range migrations {
+		if m.Namespace != namespace || m.Repeatable {
+			continue
+		}
+
+		out = append(out, m)
+		if m.Name == name {
+			break
+		}
+	}
+
+	return out, nil
+}
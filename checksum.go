@@ -0,0 +1,142 @@
+package trek
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fortytw2/lounge"
+)
+
+// An AppliedMigration is a row in the migration history of a database
+type AppliedMigration struct {
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+
+	// Duration is how long the migration took to run, zero for migrations
+	// applied before durations were recorded or marked applied by Baseline
+	Duration time.Duration
+	// Host is the instance that applied the migration, see WithInstanceID
+	Host string
+	// AppVersion is the application version that applied the migration, see
+	// WithAppVersion
+	AppVersion string
+}
+
+// Checksum returns the hex encoded sha256 of a migrations SQL, as recorded in
+// the migration history when it is applied. Go migrations have no checksum.
+func (m Migration) Checksum() string {
+	if m.IsGo() {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(m.SQL))
+	return hex.EncodeToString(sum[:])
+}
+
+// A ChecksumMismatch describes a single migration whose SQL no longer matches
+// what was applied
+type ChecksumMismatch struct {
+	Name            string
+	AppliedChecksum string
+	CurrentChecksum string
+}
+
+// ChecksumMismatchError is returned when migrations have been edited after
+// they were applied, use Repair if the edits were intended
+type ChecksumMismatchError struct {
+	Mismatches []ChecksumMismatch
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	names := make([]string, 0, len(e.Mismatches))
+	for _, m := range e.Mismatches {
+		names = append(names, m.Name)
+	}
+
+	return fmt.Sprintf("applied migrations have been modified: %s", strings.Join(names, ", "))
+}
+
+// VerifyChecksums compares every applied migration against its current SQL,
+// returning a *ChecksumMismatchError naming every migration that differs.
+// Applied migrations recorded without a checksum, without a matching
+// migration, or that are repeatable, are ignored.
+func VerifyChecksums(migrations []Migration, applied []AppliedMigration) error {
+	byName := make(map[string]Migration, len(migrations))
+	for _, m := range migrations {
+		byName[m.Name] = m
+	}
+
+	var mismatches []ChecksumMismatch
+	for _, a := range applied {
+		m, ok := byName[a.Name]
+		if !ok || a.Checksum == "" || m.Repeatable {
+			continue
+		}
+
+		current := m.Checksum()
+		if current != a.Checksum {
+			mismatches = append(mismatches, ChecksumMismatch{
+				Name:            a.Name,
+				AppliedChecksum: a.Checksum,
+				CurrentChecksum: current,
+			})
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return &ChecksumMismatchError{Mismatches: mismatches}
+	}
+
+	return nil
+}
+
+// GetChecksumUpdates returns the applied migrations whose recorded checksum
+// differs from their current SQL. When onlyMissing is set, only migrations
+// recorded without a checksum are returned.
+func GetChecksumUpdates(migrations []Migration, applied []AppliedMigration, onlyMissing bool) []Migration {
+	byName := make(map[string]Migration, len(migrations))
+	for _, m := range migrations {
+		byName[m.Name] = m
+	}
+
+	var out []Migration
+	for _, a := range applied {
+		m, ok := byName[a.Name]
+		if !ok || m.Repeatable {
+			continue
+		}
+
+		if onlyMissing && a.Checksum != "" {
+			continue
+		}
+
+		if a.Checksum != m.Checksum() {
+			out = append(out, m)
+		}
+	}
+
+	return out
+}
+
+// Repair updates the recorded checksum of every applied migration to match
+// its current SQL, accepting any edits made since it was applied. Templated
+// migrations must be rendered with RenderMigrations first.
+func Repair(db MigratableDB, log lounge.Log, allMigrations []Migration) (err error) {
+	return RepairContext(context.Background(), db, log, allMigrations)
+}
+
+// RepairContext is Repair with a context
+func RepairContext(ctx context.Context, db MigratableDB, log lounge.Log, allMigrations []Migration) (err error) {
+	err = db.RepairMigrations(ctx, log, allMigrations)
+	if err != nil {
+		log.Errorf("cannot repair migrations: %s", err)
+		return err
+	}
+
+	return nil
+}
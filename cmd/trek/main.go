@@ -0,0 +1,274 @@
+// Command trek runs migrations from a directory of SQL files against a
+// postgres or sqlite database, for deploy scripts and CI pipelines that do not
+// embed trek in a Go program.
+//
+//	trek -dsn postgres://localhost/app -dir schema up
+//	trek -dsn app.db -dir schema status
+//
+// Commands that take the migration lock fail while another instance holds
+// it, -wait makes them wait up to the given duration for it instead.
+//
+// The DSN is taken from TREK_DSN when -dsn is not given. DSNs starting with
+// postgres:// or postgresql:// open a postgres database, anything else is the
+// path of a sqlite database file, which only up and baseline create.
+//
+// trek exits 0 on success, 1 when a command fails and 2 on invalid usage.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fortytw2/lounge"
+	"github.com/fortytw2/trek"
+	"github.com/fortytw2/trek/postgresql"
+	"github.com/fortytw2/trek/sqlite"
+)
+
+const usage = `usage: trek [flags] <command> [args]
+
+commands:
+  up               apply every pending migration
+  status           list applied, pending, unknown and modified migrations
+  plan             print the migrations up would run and their SQL
+  baseline <name>  record migrations up to and including name as applied
+                   without running them
+  unlock           release the migration lock, whoever holds it
+  verify           fail if applied migrations were modified, conflict with
+                   the migration files or pending migrations are out of order
+  new <name>       create the next migration file in the migrations directory
+
+flags:
+`
+
+// errUsage is returned for invalid command lines, which exit 2
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the trek command line in args, returning its exit code
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("trek", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	dsn := flags.String("dsn", os.Getenv("TREK_DSN"), "database to migrate, a postgres:// URL or a sqlite file path")
+	dir := flags.String("dir", "schema", "directory holding the migration files")
+	appVersion := flags.String("app-version", "", "version recorded with each applied migration")
+	timeout := flags.Duration("timeout", 0, "maximum time each migration may run, 0 for no limit")
+	wait := flags.Duration("wait", 0, "maximum time to wait for the migration lock, 0 to fail at once when it is held")
+
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+
+	c := &cli{
+		stdout: stdout,
+		log:    lounge.NewDefaultLog(lounge.WithOutput(stderr)),
+		dsn:    *dsn,
+		dir:    *dir,
+		opts:   []trek.MigrateOption{trek.WithAppVersion(*appVersion), trek.FailIfLocked()},
+	}
+	if *timeout > 0 {
+		c.opts = append(c.opts, trek.WithMigrationTimeout(*timeout))
+	}
+	if *wait > 0 {
+		c.opts = append(c.opts, trek.WaitForLock(*wait))
+	}
+
+	err = c.run(context.Background(), flags.Args())
+	if errors.Is(err, errUsage) {
+		fmt.Fprintf(stderr, "trek: %s\n", err)
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "trek: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+type cli struct {
+	stdout io.Writer
+	log    lounge.Log
+	dsn    string
+	dir    string
+	opts   []trek.MigrateOption
+}
+
+func (c *cli) run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: no command given", errUsage)
+	}
+
+	command, args := args[0], args[1:]
+
+	takesName := command == "baseline" || command == "new"
+	if takesName && len(args) != 1 {
+		return fmt.Errorf("%w: %s takes one migration name", errUsage, command)
+	}
+	if !takesName && len(args) != 0 {
+		return fmt.Errorf("%w: %s takes no arguments", errUsage, command)
+	}
+
+	switch command {
+	case "new":
+		return c.newMigration(args[0])
+	case "up", "status", "plan", "baseline", "unlock", "verify":
+	default:
+		return fmt.Errorf("%w: unknown command %q", errUsage, command)
+	}
+
+	// only up and baseline create a database, checking a mistyped path must
+	// not pass against a new, empty, database
+	db, closeDB, err := c.open(command == "up" || command == "baseline")
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	if command == "unlock" {
+		return c.unlock(ctx, db)
+	}
+
+	migrations, err := trek.GetMigrations(os.DirFS(c.dir))
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "up":
+		return trek.MigrateContext(ctx, db, c.log, migrations, c.opts...)
+	case "status":
+		return c.status(ctx, db, migrations)
+	case "plan":
+		planned, err := trek.PlanContext(ctx, db, c.log, migrations, c.opts...)
+		if err != nil {
+			return err
+		}
+		return trek.WritePlan(c.stdout, planned)
+	case "baseline":
+		return trek.BaselineContext(ctx, db, migrations, args[0], c.opts...)
+	default:
+		return c.verify(ctx, db, migrations)
+	}
+}
+
+// open connects to the database named by the DSN, a sqlite database file
+// that does not exist is only created if create is set
+func (c *cli) open(create bool) (trek.MigratableDB, func(), error) {
+	switch {
+	case c.dsn == "":
+		return nil, nil, fmt.Errorf("%w: no database given, set -dsn or TREK_DSN", errUsage)
+	case strings.HasPrefix(c.dsn, "postgres://"), strings.HasPrefix(c.dsn, "postgresql://"):
+		db, err := postgresql.NewWrapper(c.dsn, c.log)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, func() {}, nil
+	default:
+		if !create {
+			_, err := os.Stat(c.dsn)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		db, err := sqlite.New(c.log, c.dsn)
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, db.Close, nil
+	}
+}
+
+func (c *cli) status(ctx context.Context, db trek.MigratableDB, migrations []trek.Migration) error {
+	report, err := trek.Status(ctx, db, migrations)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	for _, a := range report.Applied {
+		fmt.Fprintf(tw, "applied\t%s\t%s\n", a.Name, a.AppliedAt.Format(time.RFC3339))
+	}
+	for _, m := range report.Pending {
+		fmt.Fprintf(tw, "pending\t%s\t\n", m.Name)
+	}
+	for _, a := range report.Unknown {
+		fmt.Fprintf(tw, "unknown\t%s\t%s\n", a.Name, a.AppliedAt.Format(time.RFC3339))
+	}
+	for _, m := range report.Modified {
+		fmt.Fprintf(tw, "modified\t%s\t\n", m.Name)
+	}
+
+	return tw.Flush()
+}
+
+// verify checks the migration history against the migration files, pending
+// migrations are not an error so it can run before up, unless they would run
+// out of order
+func (c *cli) verify(ctx context.Context, db trek.MigratableDB, migrations []trek.Migration) error {
+	report, err := trek.Status(ctx, db, migrations)
+	if err != nil {
+		return err
+	}
+
+	err = trek.VerifyChecksums(migrations, report.Applied)
+	if err != nil {
+		return err
+	}
+
+	err = trek.VerifyVersions(migrations, report.Applied)
+	if err != nil {
+		return err
+	}
+
+	_, err = trek.GetPendingMigrations(migrations, report.Applied, false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "%d applied, %d pending, %d unknown\n", len(report.Applied), len(report.Pending), len(report.Unknown))
+
+	return nil
+}
+
+func (c *cli) unlock(ctx context.Context, db trek.MigratableDB) error {
+	holder, err := trek.CurrentLockHolder(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	if holder == nil {
+		fmt.Fprintln(c.stdout, "migration lock is not held")
+		return nil
+	}
+
+	err = trek.ForceUnlock(ctx, db, c.log)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "released migration lock held by %s\n", holder)
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/trek"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	schema := filepath.Join(dir, "schema")
+	dsn := filepath.Join(dir, "trek.db")
+
+	trekCmd := func(wantCode int, args ...string) string {
+		t.Helper()
+
+		var stdout, stderr bytes.Buffer
+		code := run(append([]string{"-dsn", dsn, "-dir", schema}, args...), &stdout, &stderr)
+		if code != wantCode {
+			t.Fatalf("trek %s exited %d, want %d\n%s", strings.Join(args, " "), code, wantCode, stderr.String())
+		}
+
+		return stdout.String()
+	}
+
+	for _, name := range []string{"create monkeys", "Name index"} {
+		trekCmd(0, "new", name)
+	}
+
+	appendSQL := func(name, sql string) {
+		t.Helper()
+
+		f, err := os.OpenFile(filepath.Join(schema, name), os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		_, err = f.WriteString(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	appendSQL("001_create_monkeys.sql", "CREATE TABLE monkeys (id integer primary key not null, name text not null);\n")
+	appendSQL("002_name_index.sql", "CREATE INDEX monkey_names ON monkeys (name);\n")
+
+	// plan only reads existing databases, an empty file is a new database
+	trekCmd(1, "plan")
+	err := os.WriteFile(dsn, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out := trekCmd(0, "plan"); !strings.Contains(out, "-- migration 2/2: 002_name_index.sql") {
+		t.Errorf("unexpected plan\n%s", out)
+	}
+
+	trekCmd(0, "up")
+
+	if out := trekCmd(0, "status"); strings.Count(out, "applied") != 2 || strings.Contains(out, "pending") {
+		t.Errorf("unexpected status\n%s", out)
+	}
+
+	trekCmd(0, "verify")
+	trekCmd(0, "unlock")
+
+	// a migration older than the latest applied one would run out of order
+	late := filepath.Join(schema, "000_late.sql")
+	err = os.WriteFile(late, []byte("SELECT 1;\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trekCmd(1, "verify")
+
+	err = os.Remove(late)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// up fails while another instance holds the lock, unless it waits
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO migration_locks (locked, owner, host, expires_at) VALUES (1, 'hung', 'ci', $1);`, time.Now().Add(time.Hour).UnixMilli())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trekCmd(0, "new", "add names")
+	trekCmd(1, "up")
+	trekCmd(1, "-wait", "300ms", "up")
+	trekCmd(0, "unlock")
+	trekCmd(0, "up")
+
+	appendSQL("001_create_monkeys.sql", "-- edited after it was applied\n")
+	trekCmd(1, "verify")
+
+	trekCmd(2, "bogus")
+	trekCmd(2, "baseline")
+}
+
+func TestRunMissingDatabase(t *testing.T) {
+	dir := t.TempDir()
+	dsn := filepath.Join(dir, "typo.db")
+
+	for _, command := range []string{"verify", "status", "plan", "unlock"} {
+		var stdout, stderr bytes.Buffer
+		code := run([]string{"-dsn", dsn, "-dir", dir, command}, &stdout, &stderr)
+		if code != 1 {
+			t.Errorf("trek %s exited %d against a missing database, want 1\n%s", command, code, stderr.String())
+		}
+	}
+
+	_, err := os.Stat(dsn)
+	if !os.IsNotExist(err) {
+		t.Errorf("a missing database was created: %v", err)
+	}
+}
+
+func TestNextVersion(t *testing.T) {
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cases := []struct {
+		names []string
+		want  string
+	}{
+		{want: "001"},
+		{names: []string{"01_init.sql", "R__views.sql"}, want: "02"},
+		{names: []string{"0009_x.sql", "nested/0042_y.sql"}, want: "0010"},
+		{names: []string{"99_x.sql"}, want: "100"},
+		{names: []string{"20211014152632_init.sql"}, want: "20220102030405"},
+		{names: []string{"2022_01_01_init.sql"}, want: "2022_01_02"},
+		{names: []string{"2022_01_01_init.sql", "2022_01_02_users.sql"}, want: "2022_01_02_03_04_05"},
+		{names: []string{"2022_01_02_01_00_init.sql"}, want: "2022_01_02_03_04_05"},
+	}
+
+	for _, c := range cases {
+		var migrations []trek.Migration
+		for _, name := range c.names {
+			migrations = append(migrations, trek.Migration{Name: name, Repeatable: trek.IsRepeatableName(name)})
+		}
+
+		got, err := nextVersion(migrations, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != c.want {
+			t.Errorf("next version after %v is %s, want %s", c.names, got, c.want)
+		}
+	}
+
+	if got := slugify("  Add Email-index! "); got != "add_email_index" {
+		t.Errorf("got slug %q", got)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/fortytw2/trek"
+)
+
+const (
+	// timestampLayout is used for new migrations once a directory is versioned
+	// by timestamp rather than by sequence number
+	timestampLayout = "20060102150405"
+	// dateLayout and dateTimeLayout are used once a directory is versioned by
+	// date, see trek.ParseVersion, the time only for a second migration on
+	// the same day
+	dateLayout     = "2006_01_02"
+	dateTimeLayout = "2006_01_02_15_04_05"
+	// defaultWidth is the zero padded width of the first migration's version
+	defaultWidth = 3
+)
+
+// newMigration creates an empty migration file named after the migration
+// that sorts last in the top level of the migrations directory
+func (c *cli) newMigration(name string) error {
+	slug := slugify(name)
+	if slug == "" {
+		return fmt.Errorf("%w: migration name %q has no letters or digits", errUsage, name)
+	}
+
+	err := os.MkdirAll(c.dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	migrations, err := trek.GetMigrations(os.DirFS(c.dir))
+	if err != nil {
+		return err
+	}
+
+	version, err := nextVersion(migrations, time.Now())
+	if err != nil {
+		return err
+	}
+
+	fileName := filepath.Join(c.dir, version+"_"+slug+".sql")
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "-- %s\n", name)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.stdout, fileName)
+
+	return nil
+}
+
+// nextVersion returns the version prefix of a new migration. It follows the
+// latest top level migration, keeping its zero padding, or is the current UTC
+// timestamp or date when the latest version is one.
+func nextVersion(migrations []trek.Migration, now time.Time) (string, error) {
+	latest := ""
+	var latestVersion trek.Version
+	for _, m := range migrations {
+		if m.Repeatable || path.Dir(m.Name) != "." {
+			continue
+		}
+
+		if v, err := trek.ParseVersion(m.Name); err == nil {
+			latest, latestVersion = m.Name, v
+		}
+	}
+
+	if latest == "" {
+		return fmt.Sprintf("%0*d", defaultWidth, 1), nil
+	}
+
+	digits := latest[:strings.IndexFunc(latest, func(r rune) bool { return !unicode.IsDigit(r) })]
+	if len(digits) == len(timestampLayout) {
+		return now.UTC().Format(timestampLayout), nil
+	}
+
+	if len(digits) == 4 && latestVersion.Number >= 1e13 {
+		for _, layout := range []string{dateLayout, dateTimeLayout} {
+			version := now.UTC().Format(layout)
+			if v, err := trek.ParseVersion(version); err == nil && v.Number > latestVersion.Number {
+				return version, nil
+			}
+		}
+
+		return "", fmt.Errorf("latest migration %s is dated after the current time", latest)
+	}
+
+	number, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%0*d", len(digits), number+1), nil
+}
+
+// slugify turns a migration description into the lower case, underscore
+// separated part of its file name
+func slugify(name string) string {
+	var b strings.Builder
+	separate := false
+	for _, r := range strings.ToLower(name) {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			separate = b.Len() > 0
+			continue
+		}
+
+		if separate {
+			b.WriteByte('_')
+			separate = false
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,46 @@
+package trek
+
+import (
+	"strings"
+)
+
+const directivePrefix = "-- trek:"
+
+// NoTransactionDirective opts a migration file out of running in a
+// transaction, for statements such as CREATE INDEX CONCURRENTLY
+//
+//	-- trek:no-transaction
+const NoTransactionDirective = "no-transaction"
+
+// EnvDirective limits a seed file to the environments listed after it
+//
+//	-- trek:env dev test
+const EnvDirective = "env"
+
+// HasDirective reports whether sql contains a `-- trek:<directive>` comment on
+// a line of its own
+func HasDirective(sql, directive string) bool {
+	_, ok := directiveArgs(sql, directive)
+	return ok
+}
+
+// directiveArgs returns the arguments of every `-- trek:<directive>` comment
+// in sql, and whether there are any
+func directiveArgs(sql, directive string) ([]string, bool) {
+	var args []string
+	found := false
+	for _, line := range strings.Split(sql, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, directivePrefix) {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, directivePrefix))
+		if len(fields) > 0 && fields[0] == directive {
+			args = append(args, fields[1:]...)
+			found = true
+		}
+	}
+
+	return args, found
+}
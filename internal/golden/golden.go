@@ -0,0 +1,68 @@
+// Package golden compares test output against checked-in golden files
+package golden
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// UpdateEnv rewrites golden files with the current output instead of
+// comparing against them when set to a non-empty value
+//
+//	TREK_UPDATE_GOLDEN=1 go test ./...
+const UpdateEnv = "TREK_UPDATE_GOLDEN"
+
+// Assert fails t if got does not match the contents of path
+func Assert(t testing.TB, path, got string) {
+	t.Helper()
+
+	if os.Getenv(UpdateEnv) != "" {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatalf("could not create golden file directory: %s", err)
+		}
+
+		err = os.WriteFile(path, []byte(got), 0644)
+		if err != nil {
+			t.Fatalf("could not update golden file: %s", err)
+		}
+
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read golden file, run with %s=1 to create it: %s", UpdateEnv, err)
+	}
+
+	if string(want) == got {
+		return
+	}
+
+	t.Errorf("%s does not match, run with %s=1 to update it\n%s", path, UpdateEnv, firstDifference(string(want), got))
+}
+
+// firstDifference describes the first line that differs between want and got
+func firstDifference(want, got string) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+
+		if w != g {
+			return fmt.Sprintf("line %d:\n- %s\n+ %s", i+1, w, g)
+		}
+	}
+
+	return ""
+}
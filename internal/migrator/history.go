@@ -0,0 +1,52 @@
+package migrator
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fortytw2/trek"
+)
+
+// historyColumns are the columns of the history table, with the value read
+// from histories that predate the column, empty for the original columns
+var historyColumns = []struct{ name, zero string }{
+	{"name", ""},
+	{"checksum", "''"},
+	{"created_at", ""},
+	{"duration_ms", "0"},
+	{"host", "''"},
+	{"app_version", "''"},
+}
+
+// HistoryQuery returns a query selecting name, checksum, created_at,
+// duration_ms, host and app_version from the history table, reading columns
+// missing from a history that has not been upgraded yet as empty. Upgrading
+// takes DDL, which is left to migrators holding the lock.
+func HistoryQuery(ctx context.Context, db trek.StdlibDB, table string) (string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT * FROM `+table+` WHERE 1 = 0`)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+
+	present := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		present[strings.ToLower(c)] = true
+	}
+
+	var selected []string
+	for _, c := range historyColumns {
+		if present[c.name] || c.zero == "" {
+			selected = append(selected, c.name)
+		} else {
+			selected = append(selected, c.zero)
+		}
+	}
+
+	return `SELECT ` + strings.Join(selected, ", ") + ` FROM ` + table + ` ORDER BY name ASC`, nil
+}
@@ -0,0 +1,326 @@
+// Package migrator runs migrations for the postgresql and sqlite backends,
+// which differ only in how they take the migration lock and the SQL their
+// history is recorded with.
+package migrator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/fortytw2/lounge"
+	"github.com/fortytw2/trek"
+)
+
+// A History records applied migrations in a backend's history table
+type History interface {
+	// AppliedMigrations returns every recorded migration, ordered by
+	// trek.SortAppliedMigrations
+	AppliedMigrations(ctx context.Context, db trek.StdlibDB) ([]trek.AppliedMigration, error)
+	// RecordMigration adds m to the history, repeatable migrations replace
+	// their previous entry
+	RecordMigration(ctx context.Context, db trek.StdlibDB, m trek.Migration, duration time.Duration, opts trek.MigrateOptions) error
+	RenameMigration(ctx context.Context, db trek.StdlibDB, from, to string) error
+	UpdateChecksum(ctx context.Context, db trek.StdlibDB, name, checksum string) error
+	DeleteMigration(ctx context.Context, db trek.StdlibDB, name string) error
+}
+
+// A Migrator runs migrations on a connection holding the migration lock
+type Migrator struct {
+	Conn    *sql.Conn
+	Log     lounge.Log
+	History History
+	Dialect trek.Dialect
+
+	// CheckLock, if set, fails once the migration lock is lost. It runs
+	// before every migration and in its transaction before it commits, so a
+	// migrator that lost the lock cannot record anything.
+	CheckLock func(ctx context.Context, db trek.StdlibDB) error
+}
+
+// Apply runs every pending migration, or hands them to opts.Plan
+func (m *Migrator) Apply(ctx context.Context, migrations []trek.Migration, opts trek.MigrateOptions) error {
+	applied, err := m.GetHistory(ctx, migrations, opts)
+	if err != nil {
+		return err
+	}
+
+	err = trek.VerifyChecksums(migrations, applied)
+	if err != nil {
+		return err
+	}
+
+	err = trek.VerifyVersions(migrations, applied)
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		m.Log.Infof("no previous migrations found, running all")
+	} else {
+		m.Log.Infof("last migration found: %s", applied[len(applied)-1].Name)
+	}
+
+	pending, err := trek.GetPendingMigrations(migrations, applied, opts.AllowOutOfOrder)
+	if err != nil {
+		return err
+	}
+
+	if opts.Plan != nil {
+		return opts.Plan(pending)
+	}
+
+	// migrations applied before checksums were recorded trust their current contents
+	for _, mig := range trek.GetChecksumUpdates(migrations, applied, true) {
+		err = m.History.UpdateChecksum(ctx, m.Conn, mig.Name, mig.Checksum())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, mig := range pending {
+		err = m.checkLock(ctx, m.Conn)
+		if err != nil {
+			return err
+		}
+
+		m.Log.Infof("running migration: %s", mig.Name)
+		err = m.applyMigration(ctx, mig, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyMigration runs mig and records it in the history, in a single
+// transaction unless mig opts out. opts.MigrationTimeout cancels mig once
+// exceeded.
+func (m *Migrator) applyMigration(ctx context.Context, mig trek.Migration, opts trek.MigrateOptions) error {
+	timeout := opts.MigrationTimeout
+	migrationCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		migrationCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	useTx := mig.IsGo() || !trek.HasDirective(mig.SQL, trek.NoTransactionDirective)
+	err := Transact(migrationCtx, m.Conn, useTx, func(db trek.StdlibDB) error {
+		start := time.Now()
+
+		var err error
+		if mig.IsGo() {
+			err = mig.Func(NewSQLWrapper(m.Log, db))
+		} else {
+			err = trek.ExecStatements(migrationCtx, db, mig.SQL, m.Dialect)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = m.checkLock(migrationCtx, db)
+		if err != nil {
+			return err
+		}
+
+		return m.History.RecordMigration(migrationCtx, db, mig, time.Since(start), opts)
+	})
+	if err != nil {
+		if ctx.Err() == nil && migrationCtx.Err() == context.DeadlineExceeded {
+			return &trek.MigrationTimeoutError{Name: mig.Name, Timeout: timeout, Err: err}
+		}
+
+		return fmt.Errorf("migration %s failed: %w", mig.Name, err)
+	}
+
+	return nil
+}
+
+// Rollback reverts migrations until targetName is the latest applied
+func (m *Migrator) Rollback(ctx context.Context, migrations []trek.Migration, targetName string) error {
+	applied, err := m.GetHistory(ctx, migrations, trek.MigrateOptions{})
+	if err != nil {
+		return err
+	}
+
+	toRollback, err := trek.GetMigrationsToRollback(migrations, applied, targetName)
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range toRollback {
+		m.Log.Infof("rolling back migration: %s", mig.Name)
+		useTx := mig.DownFunc != nil || !trek.HasDirective(mig.DownSQL, trek.NoTransactionDirective)
+		err = Transact(ctx, m.Conn, useTx, func(db trek.StdlibDB) error {
+			var err error
+			if mig.DownFunc != nil {
+				err = mig.DownFunc(NewSQLWrapper(m.Log, db))
+			} else {
+				err = trek.ExecStatements(ctx, db, mig.DownSQL, m.Dialect)
+			}
+			if err != nil {
+				return err
+			}
+
+			err = m.checkLock(ctx, db)
+			if err != nil {
+				return err
+			}
+
+			return m.History.DeleteMigration(ctx, db, mig.Name)
+		})
+		if err != nil {
+			return fmt.Errorf("rollback of %s failed: %w", mig.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Repair updates the recorded checksum of every migration whose SQL changed
+func (m *Migrator) Repair(ctx context.Context, migrations []trek.Migration) error {
+	applied, err := m.GetHistory(ctx, migrations, trek.MigrateOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range trek.GetChecksumUpdates(migrations, applied, false) {
+		m.Log.Infof("repairing checksum of migration: %s", mig.Name)
+		err = m.History.UpdateChecksum(ctx, m.Conn, mig.Name, mig.Checksum())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Baseline records migrations as applied without running them, skipping any
+// already in the history
+func (m *Migrator) Baseline(ctx context.Context, migrations []trek.Migration, opts trek.MigrateOptions) error {
+	applied, err := m.GetHistory(ctx, migrations, opts)
+	if err != nil {
+		return err
+	}
+
+	pending, err := trek.GetPendingMigrations(migrations, applied, true)
+	if err != nil {
+		return err
+	}
+
+	return Transact(ctx, m.Conn, true, func(db trek.StdlibDB) error {
+		for _, mig := range pending {
+			m.Log.Infof("baselining migration: %s", mig.Name)
+			err := m.History.RecordMigration(ctx, db, mig, 0, opts)
+			if err != nil {
+				return err
+			}
+		}
+
+		return m.checkLock(ctx, db)
+	})
+}
+
+// GetHistory returns the migration history with entries recorded under an
+// alias renamed to the current name of their migration, and squashed
+// baselines recorded once every migration they replace has been applied. The
+// history is only changed in the database when opts is not a dry run.
+func (m *Migrator) GetHistory(ctx context.Context, migrations []trek.Migration, opts trek.MigrateOptions) ([]trek.AppliedMigration, error) {
+	applied, err := m.History.AppliedMigrations(ctx, m.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	renames, err := trek.GetRenames(migrations, applied)
+	if err != nil {
+		return nil, err
+	}
+	applied = trek.ApplyRenames(applied, renames)
+
+	replacing, err := trek.GetReplacingMigrations(migrations, applied)
+	if err != nil {
+		return nil, err
+	}
+
+	if (len(renames) > 0 || len(replacing) > 0) && opts.Plan == nil {
+		err = Transact(ctx, m.Conn, true, func(db trek.StdlibDB) error {
+			for _, r := range renames {
+				m.Log.Infof("renaming migration %s to %s", r.From, r.To)
+				err := m.History.RenameMigration(ctx, db, r.From, r.To)
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, mig := range replacing {
+				m.Log.Infof("recording baseline %s, every migration it replaces is applied", mig.Name)
+				err := m.History.RecordMigration(ctx, db, mig, 0, opts)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return trek.ApplyReplacing(applied, replacing), nil
+}
+
+// SeedMigrations returns seeds as migrations, to hand the seeds a dry run
+// would apply to trek.MigrateOptions.Plan
+func SeedMigrations(seeds []trek.Seed) []trek.Migration {
+	migrations := make([]trek.Migration, 0, len(seeds))
+	for _, s := range seeds {
+		migrations = append(migrations, trek.Migration{Name: s.Name, SQL: s.SQL})
+	}
+
+	return migrations
+}
+
+func (m *Migrator) checkLock(ctx context.Context, db trek.StdlibDB) error {
+	if m.CheckLock == nil {
+		return nil
+	}
+
+	return m.CheckLock(ctx, db)
+}
+
+// Transact runs fn in a transaction on conn, or directly on conn when
+// useTx is false. The transaction is not bound to ctx, fn's statements are,
+// so a cancelled ctx rolls the transaction back before Transact returns
+// rather than in the background, where it could undo the next statement run
+// on conn, such as releasing the migration lock.
+func Transact(ctx context.Context, conn *sql.Conn, useTx bool, fn func(db trek.StdlibDB) error) error {
+	if !useTx {
+		return fn(conn)
+	}
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		rollBackErr := tx.Rollback()
+		if rollBackErr != nil && rollBackErr != sql.ErrTxDone {
+			return fmt.Errorf("error in tx and error rolling back tx: %s rollback: %w", err, rollBackErr)
+		}
+
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -1,4 +1,4 @@
-package postgresql
+package migrator
 
 import (
 	"context"
@@ -9,19 +9,21 @@ import (
 	"github.com/fortytw2/trek"
 )
 
-type sqlWrapper struct {
+// SQLWrapper implements trek.DB on a connection or transaction, for Go
+// migrations and the backends' own queries
+type SQLWrapper struct {
 	db  trek.StdlibDB
 	log lounge.Log
 }
 
-func newSQLWrapper(log lounge.Log, sqlIshDB trek.StdlibDB) *sqlWrapper {
-	return &sqlWrapper{
+func NewSQLWrapper(log lounge.Log, sqlIshDB trek.StdlibDB) *SQLWrapper {
+	return &SQLWrapper{
 		db:  sqlIshDB,
 		log: log,
 	}
 }
 
-func (w *sqlWrapper) Query(ctx context.Context, scanner trek.ScanFn, query string, args ...interface{}) error {
+func (w *SQLWrapper) Query(ctx context.Context, scanner trek.ScanFn, query string, args ...interface{}) error {
 	w.log.Debugf("executing sql statement: %q with args %+v", query, args)
 	rows, err := w.db.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -45,12 +47,12 @@ func (w *sqlWrapper) Query(ctx context.Context, scanner trek.ScanFn, query strin
 	return nil
 }
 
-func (w *sqlWrapper) QueryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+func (w *SQLWrapper) QueryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
 	w.log.Debugf("executing sql statement: %q with args %+v", query, args)
 	return w.db.QueryRowContext(ctx, query, args...)
 }
 
-func (w *sqlWrapper) Exec(ctx context.Context, query string, args ...interface{}) error {
+func (w *SQLWrapper) Exec(ctx context.Context, query string, args ...interface{}) error {
 	_, err := w.db.ExecContext(ctx, query, args...)
 	if err != nil {
 		w.log.Debugf("error in sql exec: %s", err)
@@ -60,6 +62,6 @@ func (w *sqlWrapper) Exec(ctx context.Context, query string, args ...interface{}
 	return err
 }
 
-func (w *sqlWrapper) Transact(ctx context.Context, txFn trek.TxFn) error {
+func (w *SQLWrapper) Transact(ctx context.Context, txFn trek.TxFn) error {
 	return errors.New("cannot execute nested transaction")
 }
@@ -0,0 +1,257 @@
+// Package sqlsplit splits migration files into statements, shared by the
+// migrator and the linter
+package sqlsplit
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A Dialect selects the quoting and block rules of a database
+type Dialect int
+
+const (
+	Postgres Dialect = iota
+	SQLite
+)
+
+// A Statement is a single statement of a file
+type Statement struct {
+	// Start and End are the byte offsets of the statement in the file,
+	// from its first token up to, not including, its terminating semicolon
+	Start, End int
+	// Line is the 1-indexed line of the file the statement starts on
+	Line int
+	// Code is the statement with comments and string literals blanked out,
+	// so keywords can be matched without false positives. Quoted
+	// identifiers are kept, and offsets into Code are offsets from Start.
+	Code string
+}
+
+// LineAt returns the line of the file offset into Code is on
+func (s Statement) LineAt(offset int) int {
+	return s.Line + strings.Count(s.Code[:offset], "\n")
+}
+
+var (
+	triggerRe     = regexp.MustCompile(`(?is)^CREATE\s+(?:(?:TEMP|TEMPORARY)\s+)?TRIGGER\b`)
+	beginAtomicRe = regexp.MustCompile(`(?i)\bBEGIN\s+ATOMIC\b`)
+	beginRe       = regexp.MustCompile(`(?i)\bBEGIN\b`)
+	blockWordRe   = regexp.MustCompile(`(?i)\b(CASE|END)\b`)
+)
+
+// Split splits sql into statements, understanding quoted strings and
+// identifiers, comments, postgres dollar-quoted bodies and BEGIN ATOMIC
+// function bodies, and sqlite CREATE TRIGGER ... BEGIN ... END blocks.
+// Statements holding only comments are dropped.
+func Split(sql string, dialect Dialect) []Statement {
+	var statements []Statement
+	var code strings.Builder
+
+	line := 1
+	start, startLine := -1, 0
+
+	flush := func(end int) {
+		if start >= 0 {
+			statements = append(statements, Statement{
+				Start: start,
+				End:   end,
+				Line:  startLine,
+				Code:  code.String(),
+			})
+		}
+		code.Reset()
+		start = -1
+	}
+
+	// begin marks the first token of a statement at i
+	begin := func(i int) {
+		if start < 0 {
+			start, startLine = i, line
+		}
+	}
+
+	// blank writes s to code with everything but newlines replaced
+	blank := func(s string) {
+		for _, r := range s {
+			if r == '\n' {
+				code.WriteRune('\n')
+			} else {
+				code.WriteRune(' ')
+			}
+		}
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		var skip int
+		isComment, keep := false, false
+		switch {
+		case strings.HasPrefix(sql[i:], "--"):
+			skip = strings.IndexByte(sql[i:], '\n')
+			if skip < 0 {
+				skip = len(sql) - i
+			}
+			isComment = true
+		case strings.HasPrefix(sql[i:], "/*"):
+			skip = blockCommentLength(sql[i:], dialect == Postgres)
+			isComment = true
+		case c == '\'':
+			escapes := dialect == Postgres && i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e')
+			skip = quotedLength(sql[i:], '\'', '\'', escapes)
+		case c == '"':
+			skip, keep = quotedLength(sql[i:], '"', '"', false), true
+		case c == '`' && dialect == SQLite:
+			skip, keep = quotedLength(sql[i:], '`', '`', false), true
+		case c == '[' && dialect == SQLite:
+			skip, keep = quotedLength(sql[i:], '[', ']', false), true
+		case c == '$' && dialect == Postgres:
+			skip = dollarQuotedLength(sql[i:])
+		}
+
+		if skip > 0 {
+			// comments before a statement are not part of it
+			if !isComment {
+				begin(i)
+			}
+
+			if start >= 0 {
+				if keep {
+					code.WriteString(sql[i : i+skip])
+				} else {
+					blank(sql[i : i+skip])
+				}
+			}
+
+			line += strings.Count(sql[i:i+skip], "\n")
+			i += skip
+			continue
+		}
+
+		if c == ';' && !inBlock(code.String(), dialect) {
+			flush(i)
+			i++
+			continue
+		}
+
+		if c == '\n' {
+			line++
+		}
+
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			begin(i)
+		}
+
+		if start >= 0 {
+			code.WriteByte(c)
+		}
+		i++
+	}
+
+	flush(len(sql))
+
+	return statements
+}
+
+// inBlock reports whether code stops inside a BEGIN ... END block, where
+// semicolons end the statements of the block rather than code itself
+func inBlock(code string, dialect Dialect) bool {
+	var loc []int
+	switch dialect {
+	case SQLite:
+		if !triggerRe.MatchString(code) {
+			return false
+		}
+		loc = beginRe.FindStringIndex(code)
+	case Postgres:
+		loc = beginAtomicRe.FindStringIndex(code)
+	}
+
+	if loc == nil {
+		return false
+	}
+
+	depth := 0
+	for _, word := range blockWordRe.FindAllString(code[loc[1]:], -1) {
+		if strings.EqualFold(word, "CASE") {
+			depth++
+			continue
+		}
+
+		if depth == 0 {
+			return false
+		}
+		depth--
+	}
+
+	return true
+}
+
+// blockCommentLength returns the length of the block comment at the start of
+// s, postgres block comments nest
+func blockCommentLength(s string, nested bool) int {
+	depth := 0
+	for i := 0; i < len(s)-1; i++ {
+		switch s[i : i+2] {
+		case "/*":
+			if depth == 0 || nested {
+				depth++
+			}
+			i++
+		case "*/":
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+
+	return len(s)
+}
+
+// quotedLength returns the length of the literal at the start of s, closed by
+// close, where a doubled close is an escaped close
+func quotedLength(s string, open, close byte, backslashEscapes bool) int {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case backslashEscapes && s[i] == '\\':
+			i++
+		case s[i] == close && open == close && i+1 < len(s) && s[i+1] == close:
+			i++
+		case s[i] == close:
+			return i + 1
+		}
+	}
+
+	return len(s)
+}
+
+// dollarQuotedLength returns the length of the $tag$ ... $tag$ literal at the
+// start of s, or 0 if s does not start with a dollar quote
+func dollarQuotedLength(s string) int {
+	end := strings.IndexByte(s[1:], '$')
+	if end < 0 {
+		return 0
+	}
+
+	tag := s[:end+2]
+	for _, r := range tag[1 : len(tag)-1] {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return 0
+		}
+	}
+
+	// $1 style parameters are not dollar quotes
+	if len(tag) > 2 && tag[1] >= '0' && tag[1] <= '9' {
+		return 0
+	}
+
+	closing := strings.Index(s[len(tag):], tag)
+	if closing < 0 {
+		return len(s)
+	}
+
+	return len(tag) + closing + len(tag)
+}
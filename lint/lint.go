@@ -0,0 +1,307 @@
+// Package lint flags postgres migrations that take long ACCESS EXCLUSIVE locks
+// or rewrite tables, before they cause an outage in production.
+//
+// Every finding names the rule that raised it, a finding is suppressed by a
+// comment naming the rule, either on the flagged line or on a line of its own
+// directly before it
+//
+//	-- trek:ignore index-not-concurrent
+//	CREATE INDEX users_email ON users (email);
+package lint
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/fortytw2/trek"
+	"github.com/fortytw2/trek/internal/sqlsplit"
+)
+
+// IgnoreDirective suppresses findings of the rules listed after it
+const IgnoreDirective = "ignore"
+
+// A Rule is a class of dangerous operation the linter detects
+type Rule struct {
+	ID          string
+	Description string
+}
+
+// Rules is every rule Check applies
+var Rules = []Rule{
+	{"index-not-concurrent", "CREATE INDEX and REINDEX without CONCURRENTLY block writes to the table until the index is built"},
+	{"concurrent-in-transaction", "CREATE INDEX, DROP INDEX and REINDEX CONCURRENTLY, and ALTER TYPE ... ADD VALUE before PostgreSQL 12, cannot run inside a transaction, the migration needs -- trek:no-transaction"},
+	{"add-column-default", "ADD COLUMN with a DEFAULT rewrites the table under an ACCESS EXCLUSIVE lock before Postgres 11, and on any version when the default is volatile"},
+	{"alter-column-type", "ALTER COLUMN ... TYPE rewrites the table and its indexes under an ACCESS EXCLUSIVE lock"},
+	{"set-not-null", "SET NOT NULL scans the whole table under an ACCESS EXCLUSIVE lock, add a NOT VALID CHECK constraint and validate it first"},
+	{"constraint-not-valid", "adding a FOREIGN KEY or CHECK constraint without NOT VALID scans the whole table while blocking writes, add it NOT VALID and VALIDATE it separately"},
+	{"add-unique-constraint", "adding a UNIQUE or PRIMARY KEY constraint builds its index under an ACCESS EXCLUSIVE lock, build the index CONCURRENTLY and add the constraint USING INDEX"},
+	{"vacuum-full", "VACUUM FULL rewrites the table under an ACCESS EXCLUSIVE lock"},
+	{"cluster", "CLUSTER rewrites the table under an ACCESS EXCLUSIVE lock"},
+}
+
+// A Finding is a dangerous statement in a migration
+type Finding struct {
+	Migration string
+	// Line is the 1-indexed line of the migration the statement is on
+	Line    int
+	Rule    string
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s:%d: %s (%s)", f.Migration, f.Line, f.Message, f.Rule)
+}
+
+// Error is returned by Verify when any migration has findings
+type Error struct {
+	Findings []Finding
+}
+
+func (e *Error) Error() string {
+	lines := make([]string, 0, len(e.Findings))
+	for _, f := range e.Findings {
+		lines = append(lines, f.String())
+	}
+
+	return fmt.Sprintf("%d dangerous migration statements:\n%s", len(e.Findings), strings.Join(lines, "\n"))
+}
+
+// Verify runs Check and returns an *Error listing every finding, for use in
+// tests or before trek.Migrate
+func Verify(migrations []trek.Migration) error {
+	findings := Check(migrations)
+	if len(findings) > 0 {
+		return &Error{Findings: findings}
+	}
+
+	return nil
+}
+
+// Check lints the SQL of every migration, usually the pending migrations
+// returned by trek.Plan, Go migrations are skipped. Operations on tables
+// created earlier in the same migration are not flagged, as the table is
+// still empty.
+func Check(migrations []trek.Migration) []Finding {
+	var findings []Finding
+	for _, m := range migrations {
+		if m.IsGo() {
+			continue
+		}
+
+		findings = append(findings, checkMigration(m)...)
+	}
+
+	return findings
+}
+
+const ident = `("[^"]*"|[\w.$]+)`
+
+var (
+	createTableRe = regexp.MustCompile(`(?is)^\s*CREATE\s+(?:(?:GLOBAL|LOCAL)\s+)?(?:(?:TEMP|TEMPORARY|UNLOGGED)\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?` + ident)
+	createIndexRe = regexp.MustCompile(`(?is)^\s*CREATE\s+(?:UNIQUE\s+)?INDEX\b`)
+	reindexRe     = regexp.MustCompile(`(?is)^\s*REINDEX\b`)
+	dropIndexRe   = regexp.MustCompile(`(?is)^\s*DROP\s+INDEX\b`)
+	addValueRe    = regexp.MustCompile(`(?is)^\s*ALTER\s+TYPE\s+` + ident + `\s+ADD\s+VALUE\b`)
+	indexTableRe  = regexp.MustCompile(`(?is)\bON\s+(?:ONLY\s+)?` + ident)
+	concurrentRe  = regexp.MustCompile(`(?i)\bCONCURRENTLY\b`)
+	alterTableRe  = regexp.MustCompile(`(?is)^\s*ALTER\s+TABLE\s+(?:IF\s+EXISTS\s+)?(?:ONLY\s+)?` + ident)
+	vacuumFullRe  = regexp.MustCompile(`(?is)^\s*VACUUM\s+(?:FULL\b|\([^)]*\bFULL\b)`)
+	clusterRe     = regexp.MustCompile(`(?is)^\s*CLUSTER\b`)
+
+	addColumnRe      = regexp.MustCompile(`(?is)^\s*ADD\s+(?:COLUMN\s+)?(?:IF\s+NOT\s+EXISTS\s+)?` + ident)
+	defaultRe        = regexp.MustCompile(`(?i)\bDEFAULT\b`)
+	alterTypeRe      = regexp.MustCompile(`(?is)^\s*ALTER\s+(?:COLUMN\s+)?` + ident + `\s+(?:SET\s+DATA\s+)?TYPE\b`)
+	setNotNullRe     = regexp.MustCompile(`(?is)^\s*ALTER\s+(?:COLUMN\s+)?` + ident + `\s+SET\s+NOT\s+NULL\b`)
+	addConstraintRe  = regexp.MustCompile(`(?is)^\s*ADD\s+(?:CONSTRAINT\s+` + ident + `\s+)?(FOREIGN\s+KEY|CHECK|UNIQUE|PRIMARY\s+KEY)\b`)
+	notValidRe       = regexp.MustCompile(`(?i)\bNOT\s+VALID\b`)
+	usingIndexRe     = regexp.MustCompile(`(?i)\bUSING\s+INDEX\b`)
+	constraintWordRe = regexp.MustCompile(`(?i)^(CONSTRAINT|FOREIGN|CHECK|UNIQUE|PRIMARY|EXCLUDE)$`)
+)
+
+func checkMigration(m trek.Migration) []Finding {
+	ignored := ignoredRules(m.SQL)
+	noTransaction := trek.HasDirective(m.SQL, trek.NoTransactionDirective)
+
+	var findings []Finding
+	created := make(map[string]bool)
+	for _, st := range sqlsplit.Split(m.SQL, sqlsplit.Postgres) {
+		report := func(offset int, rule, format string, args ...interface{}) {
+			line := st.LineAt(offset)
+			if ignored[line][rule] || ignored[st.Line][rule] {
+				return
+			}
+
+			findings = append(findings, Finding{
+				Migration: m.Name,
+				Line:      line,
+				Rule:      rule,
+				Message:   fmt.Sprintf(format, args...),
+			})
+		}
+
+		code := st.Code
+
+		if match := createTableRe.FindStringSubmatch(code); match != nil {
+			created[normalizeIdent(match[1])] = true
+			continue
+		}
+
+		// only index builds and drops refuse to run CONCURRENTLY in a
+		// transaction, REFRESH MATERIALIZED VIEW CONCURRENTLY does not
+		concurrent := concurrentRe.MatchString(code)
+		indexStatement := createIndexRe.MatchString(code) || dropIndexRe.MatchString(code) || reindexRe.MatchString(code)
+		if !noTransaction {
+			if concurrent && indexStatement {
+				report(0, "concurrent-in-transaction", "CONCURRENTLY cannot run inside a transaction, add -- trek:%s", trek.NoTransactionDirective)
+			}
+
+			if addValueRe.MatchString(code) {
+				report(0, "concurrent-in-transaction", "ALTER TYPE ... ADD VALUE cannot run inside a transaction before PostgreSQL 12, add -- trek:%s", trek.NoTransactionDirective)
+			}
+		}
+
+		switch {
+		case createIndexRe.MatchString(code):
+			match := indexTableRe.FindStringSubmatch(code)
+			if concurrent || match == nil || created[normalizeIdent(match[1])] {
+				continue
+			}
+			report(0, "index-not-concurrent", "CREATE INDEX on %s without CONCURRENTLY blocks writes until the index is built", match[1])
+
+		case reindexRe.MatchString(code):
+			if !concurrent {
+				report(0, "index-not-concurrent", "REINDEX without CONCURRENTLY blocks writes until the index is rebuilt")
+			}
+
+		case vacuumFullRe.MatchString(code):
+			report(0, "vacuum-full", "VACUUM FULL rewrites the table under an ACCESS EXCLUSIVE lock")
+
+		case clusterRe.MatchString(code):
+			report(0, "cluster", "CLUSTER rewrites the table under an ACCESS EXCLUSIVE lock")
+
+		case alterTableRe.MatchString(code):
+			loc := alterTableRe.FindStringSubmatchIndex(code)
+			table := code[loc[2]:loc[3]]
+			if created[normalizeIdent(table)] {
+				continue
+			}
+
+			for _, a := range splitActions(code, loc[1]) {
+				checkAction(table, code[a[0]:a[1]], a[0], report)
+			}
+		}
+	}
+
+	return findings
+}
+
+// checkAction lints a single action of an ALTER TABLE statement, offset is the
+// offset of action in its statement
+func checkAction(table, action string, offset int, report func(offset int, rule, format string, args ...interface{})) {
+	offset += len(action) - len(strings.TrimLeft(action, " \t\r\n"))
+
+	if match := addConstraintRe.FindStringSubmatch(action); match != nil {
+		kind := strings.ToUpper(strings.Join(strings.Fields(match[2]), " "))
+		switch {
+		case (kind == "FOREIGN KEY" || kind == "CHECK") && !notValidRe.MatchString(action):
+			report(offset, "constraint-not-valid", "adding %s constraint to %s without NOT VALID scans the table while blocking writes", kind, table)
+		case (kind == "UNIQUE" || kind == "PRIMARY KEY") && !usingIndexRe.MatchString(action):
+			report(offset, "add-unique-constraint", "adding %s constraint to %s builds its index under an ACCESS EXCLUSIVE lock, add it USING INDEX", kind, table)
+		}
+		return
+	}
+
+	if match := addColumnRe.FindStringSubmatch(action); match != nil && !constraintWordRe.MatchString(match[1]) {
+		if defaultRe.MatchString(action) {
+			report(offset, "add-column-default", "ADD COLUMN %s with a DEFAULT rewrites %s before Postgres 11, and on any version when the default is volatile", match[1], table)
+		}
+		return
+	}
+
+	if match := alterTypeRe.FindStringSubmatch(action); match != nil {
+		report(offset, "alter-column-type", "changing the type of %s.%s rewrites the table under an ACCESS EXCLUSIVE lock", table, match[1])
+		return
+	}
+
+	if match := setNotNullRe.FindStringSubmatch(action); match != nil {
+		report(offset, "set-not-null", "SET NOT NULL on %s.%s scans the table under an ACCESS EXCLUSIVE lock", table, match[1])
+	}
+}
+
+// splitActions returns the start and end offsets of every comma separated
+// action of an ALTER TABLE statement, starting from offset
+func splitActions(code string, offset int) [][2]int {
+	var actions [][2]int
+
+	depth := 0
+	start := offset
+	for i := offset; i < len(code); i++ {
+		switch code[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				actions = append(actions, [2]int{start, i})
+				start = i + 1
+			}
+		}
+	}
+
+	return append(actions, [2]int{start, len(code)})
+}
+
+// ignoredRules returns the rules suppressed on each line of sql. A
+// `-- trek:ignore` comment suppresses rules on its own line and, when it is on
+// a line of its own, on the next line with SQL on it.
+func ignoredRules(sql string) map[int]map[string]bool {
+	ignored := make(map[int]map[string]bool)
+
+	var carried []string
+	for i, line := range strings.Split(sql, "\n") {
+		lineNum := i + 1
+
+		rules := append([]string(nil), carried...)
+		carried = nil
+
+		trimmed := strings.TrimSpace(line)
+		if idx := strings.Index(line, "-- trek:"+IgnoreDirective); idx >= 0 {
+			directive := strings.TrimPrefix(line[idx:], "-- trek:"+IgnoreDirective)
+			named := strings.FieldsFunc(directive, func(r rune) bool {
+				return r == ' ' || r == ',' || r == '\t' || r == '\r'
+			})
+			rules = append(rules, named...)
+
+			if strings.HasPrefix(trimmed, "--") {
+				carried = rules
+			}
+		} else if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			carried = rules
+		}
+
+		for _, r := range rules {
+			if ignored[lineNum] == nil {
+				ignored[lineNum] = make(map[string]bool)
+			}
+			ignored[lineNum][r] = true
+		}
+	}
+
+	return ignored
+}
+
+// normalizeIdent folds unquoted identifiers to lower case, as postgres does
+func normalizeIdent(name string) string {
+	var parts []string
+	for _, p := range strings.Split(name, ".") {
+		if strings.HasPrefix(p, `"`) {
+			parts = append(parts, strings.Trim(p, `"`))
+		} else {
+			parts = append(parts, strings.ToLower(p))
+		}
+	}
+
+	return strings.Join(parts, ".")
+}
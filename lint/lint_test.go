@@ -0,0 +1,134 @@
+package lint_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/fortytw2/trek"
+	"github.com/fortytw2/trek/lint"
+)
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		name  string
+		sql   string
+		rules []string
+		lines []int
+	}{
+		{
+			name:  "index without concurrently",
+			sql:   "CREATE INDEX users_email ON users (email);",
+			rules: []string{"index-not-concurrent"},
+			lines: []int{1},
+		},
+		{
+			name: "index on table created in the same migration",
+			sql:  "CREATE TABLE users (id integer, email text);\nCREATE UNIQUE INDEX users_email ON users (email);",
+		},
+		{
+			name:  "concurrent index in a transaction",
+			sql:   "CREATE INDEX CONCURRENTLY users_email ON users (email);",
+			rules: []string{"concurrent-in-transaction"},
+			lines: []int{1},
+		},
+		{
+			name: "concurrent index without a transaction",
+			sql:  "-- trek:no-transaction\nCREATE INDEX CONCURRENTLY users_email ON users (email);",
+		},
+		{
+			name:  "concurrent index drop in a transaction",
+			sql:   "DROP INDEX CONCURRENTLY users_email;",
+			rules: []string{"concurrent-in-transaction"},
+			lines: []int{1},
+		},
+		{
+			name: "concurrent materialized view refresh in a transaction",
+			sql:  "REFRESH MATERIALIZED VIEW CONCURRENTLY user_totals;",
+		},
+		{
+			name:  "enum value added in a transaction",
+			sql:   "ALTER TYPE mood ADD VALUE 'curious';",
+			rules: []string{"concurrent-in-transaction"},
+			lines: []int{1},
+		},
+		{
+			name:  "column with default and type change",
+			sql:   "-- widen ids\nALTER TABLE users\n  ADD COLUMN active boolean NOT NULL DEFAULT true,\n  ALTER COLUMN id TYPE bigint;",
+			rules: []string{"add-column-default", "alter-column-type"},
+			lines: []int{3, 4},
+		},
+		{
+			name:  "constraints",
+			sql:   "ALTER TABLE posts ADD CONSTRAINT posts_user FOREIGN KEY (user_id) REFERENCES users (id);\nALTER TABLE posts ADD CONSTRAINT posts_user_id CHECK (user_id > 0) NOT VALID;\nALTER TABLE posts ADD UNIQUE (slug);",
+			rules: []string{"constraint-not-valid", "add-unique-constraint"},
+			lines: []int{1, 3},
+		},
+		{
+			name:  "set not null",
+			sql:   "ALTER TABLE posts ALTER COLUMN user_id SET NOT NULL;",
+			rules: []string{"set-not-null"},
+			lines: []int{1},
+		},
+		{
+			name:  "rewrites",
+			sql:   "VACUUM (FULL, ANALYZE) posts;\nCLUSTER posts USING posts_pkey;",
+			rules: []string{"vacuum-full", "cluster"},
+			lines: []int{1, 2},
+		},
+		{
+			name: "keywords in strings, comments and function bodies",
+			sql:  "-- CREATE INDEX a ON b (c);\nINSERT INTO notes (body) VALUES ('ALTER TABLE x ALTER COLUMN y TYPE int;');\nCREATE FUNCTION f() RETURNS void AS $$ VACUUM FULL x; $$ LANGUAGE sql;",
+		},
+		{
+			name: "ignored on the line before",
+			sql:  "-- trek:ignore index-not-concurrent\nCREATE INDEX users_email ON users (email);",
+		},
+		{
+			name:  "ignored on the same line",
+			sql:   "ALTER TABLE users ADD COLUMN active boolean DEFAULT true; -- trek:ignore add-column-default\nCREATE INDEX users_active ON users (active);",
+			rules: []string{"index-not-concurrent"},
+			lines: []int{2},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			findings := lint.Check([]trek.Migration{{Name: "01_test.sql", SQL: c.sql}})
+
+			var rules []string
+			var lines []int
+			for _, f := range findings {
+				rules = append(rules, f.Rule)
+				lines = append(lines, f.Line)
+			}
+
+			if !reflect.DeepEqual(rules, c.rules) || !reflect.DeepEqual(lines, c.lines) {
+				t.Errorf("got rules %v on lines %v, want %v on lines %v", rules, lines, c.rules, c.lines)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	migrations := []trek.Migration{
+		{Name: "01_init.sql", SQL: "CREATE TABLE users (id integer);"},
+		{Name: "02_index.sql", SQL: "\nCREATE INDEX users_id ON users (id);"},
+	}
+
+	err := lint.Verify(migrations)
+
+	var lintErr *lint.Error
+	if !errors.As(err, &lintErr) || len(lintErr.Findings) != 1 {
+		t.Fatalf("got %v, want one finding", err)
+	}
+
+	want := "02_index.sql:2: CREATE INDEX on users without CONCURRENTLY blocks writes until the index is built (index-not-concurrent)"
+	if got := lintErr.Findings[0].String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := lint.Verify(migrations[:1]); err != nil {
+		t.Errorf("got %v, want no findings", err)
+	}
+}
@@ -0,0 +1,63 @@
+package trek
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fortytw2/lounge"
+)
+
+// A LockHolder describes the migrator holding the migration lock
+type LockHolder struct {
+	// Owner identifies the migrator, unique to each time the lock is taken
+	Owner string
+	// Host is the instance the migrator runs on
+	Host       string
+	AcquiredAt time.Time
+	// ExpiresAt is when the lease on the lock runs out unless the holder
+	// renews it, after which another migrator takes the lock over. It is
+	// zero for locks released by the database when the holder disconnects.
+	ExpiresAt time.Time
+}
+
+func (h *LockHolder) String() string {
+	s := fmt.Sprintf("%s on %s since %s", h.Owner, h.Host, h.AcquiredAt.Format(time.RFC3339))
+	if !h.ExpiresAt.IsZero() {
+		s += fmt.Sprintf(", lease expires %s", h.ExpiresAt.Format(time.RFC3339))
+	}
+
+	return s
+}
+
+// CurrentLockHolder returns the migrator holding the migration lock of db, or
+// nil if the lock is free
+func CurrentLockHolder(ctx context.Context, db MigratableDB) (*LockHolder, error) {
+	return db.MigrationLockHolder(ctx)
+}
+
+// ForceUnlock releases the migration lock of db whoever holds it, for
+// recovering from a migrator that crashed or hung. Migrations the holder is
+// still running are not stopped, unless the backend documents otherwise.
+func ForceUnlock(ctx context.Context, db MigratableDB, log lounge.Log) error {
+	holder, err := db.MigrationLockHolder(ctx)
+	if err != nil {
+		log.Errorf("cannot inspect migration lock: %s", err)
+		return err
+	}
+
+	if holder == nil {
+		log.Infof("migration lock is not held")
+		return nil
+	}
+
+	log.Infof("force unlocking migration lock held by %s", holder)
+
+	err = db.ForceUnlockMigrations(ctx)
+	if err != nil {
+		log.Errorf("cannot force unlock migrations: %s", err)
+		return err
+	}
+
+	return nil
+}
@@ -1,20 +1,107 @@
 package trek
 
 import (
+	"context"
+	"fmt"
+	"strings"
+
 	"github.com/fortytw2/lounge"
 )
 
 type MigratableDB interface {
-	ApplyMigrations(lounge.Log, []Migration) error
+	ApplyMigrations(context.Context, lounge.Log, []Migration, MigrateOptions) error
+	RollbackMigrations(ctx context.Context, log lounge.Log, migrations []Migration, targetName string) error
+	RepairMigrations(context.Context, lounge.Log, []Migration) error
+	AppliedMigrations(context.Context) ([]AppliedMigration, error)
+	BaselineMigrations(context.Context, []Migration, MigrateOptions) error
+	MigrationLockHolder(context.Context) (*LockHolder, error)
+	ForceUnlockMigrations(context.Context) error
+	ApplySeeds(context.Context, lounge.Log, []Seed, MigrateOptions) error
 }
 
 type Migration struct {
 	Name string
 	SQL  string
+	// DownSQL reverts SQL, it is empty if the migration cannot be rolled back
+	DownSQL string
+
+	// Func runs Go code in place of SQL, always inside a transaction, see
+	// AddGoMigrations
+	Func TxFn
+	// DownFunc reverts Func, it is nil if the migration cannot be rolled back
+	DownFunc TxFn
+
+	// Repeatable migrations, named R__name.sql, run after every versioned
+	// migration whenever their checksum changes, for views, functions and
+	// triggers that are redefined in place
+	Repeatable bool
+
+	// Namespace is the Source the migration was loaded from, migrations are
+	// ordered and checked for gaps within their namespace
+	Namespace string
+
+	// Aliases are previous names of the migration, history entries recorded
+	// under an alias are renamed to Name before migrating, see AddAliases
+	Aliases []string
+
+	// Replaces are the migrations a squashed baseline stands in for, a history
+	// with all of them applied records the baseline without running it, see
+	// Squash
+	Replaces []string
+}
+
+// IsGo reports whether the migration runs Go code rather than SQL
+func (m Migration) IsGo() bool {
+	return m.Func != nil
+}
+
+// AddGoMigrations merges Go migrations into migrations loaded with
+// GetMigrations. Go migration names share the history table with SQL
+// migrations, so they must sort into the same sequence as the file names they
+// run between, e.g. `02_backfill_names.go` runs between `02_add_names.sql` and
+// `03_names_not_null.sql`.
+func AddGoMigrations(migrations []Migration, goMigrations ...Migration) ([]Migration, error) {
+	names := make(map[string]bool, len(migrations)+len(goMigrations))
+	for _, m := range migrations {
+		names[m.Name] = true
+	}
+
+	out := append([]Migration(nil), migrations...)
+	for _, m := range goMigrations {
+		if m.Func == nil {
+			return nil, fmt.Errorf("go migration %s has no Func", m.Name)
+		}
+
+		if names[m.Name] {
+			return nil, fmt.Errorf("duplicate migration name: %s", m.Name)
+		}
+		names[m.Name] = true
+
+		out = append(out, m)
+	}
+
+	sortMigrations(out)
+
+	return out, nil
+}
+
+func Migrate(db MigratableDB, log lounge.Log, allMigrations []Migration, opts ...MigrateOption) (err error) {
+	return MigrateContext(context.Background(), db, log, allMigrations, opts...)
 }
 
-func Migrate(db MigratableDB, log lounge.Log, allMigrations []Migration) (err error) {
-	err = db.ApplyMigrations(log, allMigrations)
+// MigrateContext is Migrate with a context that is threaded through locking,
+// reading the history and every migration. Cancelling ctx stops migrating after
+// rolling back the migration in progress.
+func MigrateContext(ctx context.Context, db MigratableDB, log lounge.Log, allMigrations []Migration, opts ...MigrateOption) (err error) {
+	o := newMigrateOptions(opts)
+
+	allMigrations, err = prepareMigrations(allMigrations, o)
+	if err != nil {
+		log.Errorf("cannot apply migrations: %s", err)
+		return err
+	}
+
+	err = db.ApplyMigrations(ctx, log, allMigrations, o)
 	if err != nil {
 		log.Errorf("cannot apply migrations: %s", err)
 		return err
@@ -23,13 +110,157 @@ func Migrate(db MigratableDB, log lounge.Log, allMigrations []Migration) (err er
 	return nil
 }
 
+// Rollback runs the down scripts of every applied migration after targetName,
+// newest first, and removes them from the migration history. targetName itself
+// stays applied, an empty targetName rolls back every migration. Templated
+// migrations must be rendered with RenderMigrations first.
+func Rollback(db MigratableDB, log lounge.Log, allMigrations []Migration, targetName string) (err error) {
+	return RollbackContext(context.Background(), db, log, allMigrations, targetName)
+}
+
+// RollbackContext is Rollback with a context
+func RollbackContext(ctx context.Context, db MigratableDB, log lounge.Log, allMigrations []Migration, targetName string) (err error) {
+	err = db.RollbackMigrations(ctx, log, allMigrations, targetName)
+	if err != nil {
+		log.Errorf("cannot rollback migrations: %s", err)
+		return err
+	}
+
+	return nil
+}
+
 func GetMigrationsAfter(migrations []Migration, latestName string) []Migration {
 	var out []Migration
 	for _, m := range migrations {
-		if m.Name > latestName {
+		if CompareNames(m.Name, latestName) > 0 {
 			out = append(out, m)
 		}
 	}
 
 	return out
 }
+
+// OutOfOrderError is returned when migrations that sort before the latest
+// applied migration have never been applied, see AllowOutOfOrder
+type OutOfOrderError struct {
+	Latest  string
+	Missing []string
+}
+
+func (e *OutOfOrderError) Error() string {
+	return fmt.Sprintf("migrations before latest applied migration %s have not been applied: %s", e.Latest, strings.Join(e.Missing, ", "))
+}
+
+// GetPendingMigrations returns every migration missing from the applied
+// history, in order, followed by every repeatable migration that is new or
+// has changed. Missing migrations that sort before the latest applied
+// migration of their namespace return an *OutOfOrderError unless
+// allowOutOfOrder is set.
+func GetPendingMigrations(migrations []Migration, applied []AppliedMigration, allowOutOfOrder bool) ([]Migration, error) {
+	namespaces := migrationNamespaces(migrations)
+
+	appliedChecksums := make(map[string]string, len(applied))
+	latestNames := make(map[string]string)
+	for _, a := range applied {
+		appliedChecksums[a.Name] = a.Checksum
+
+		if IsRepeatableName(a.Name) {
+			continue
+		}
+
+		ns := namespaceOf(a.Name, namespaces)
+		if latest, ok := latestNames[ns]; !ok || CompareNames(a.Name, latest) > 0 {
+			latestNames[ns] = a.Name
+		}
+	}
+
+	var pending []Migration
+	var repeatable []Migration
+	var missing, latest []string
+	for _, m := range migrations {
+		checksum, isApplied := appliedChecksums[m.Name]
+
+		if m.Repeatable {
+			if !isApplied || checksum != m.Checksum() {
+				repeatable = append(repeatable, m)
+			}
+			continue
+		}
+
+		if isApplied {
+			continue
+		}
+
+		if latestName, ok := latestNames[m.Namespace]; ok && CompareNames(m.Name, latestName) < 0 {
+			missing = append(missing, m.Name)
+			latest = append(latest, latestName)
+		}
+
+		pending = append(pending, m)
+	}
+
+	if len(missing) > 0 && !allowOutOfOrder {
+		return nil, &OutOfOrderError{
+			Latest:  latest[len(latest)-1],
+			Missing: missing,
+		}
+	}
+
+	return append(pending, repeatable...), nil
+}
+
+// GetMigrationsToRollback returns the migrations that must be reverted, in the
+// order they must be reverted, to bring a database with the applied migrations
+// back to targetName. Only migrations in the namespace of targetName are
+// reverted, an empty targetName reverts every namespace.
+func GetMigrationsToRollback(migrations []Migration, applied []AppliedMigration, targetName string) ([]Migration, error) {
+	byName := make(map[string]Migration, len(migrations))
+	for _, m := range migrations {
+		byName[m.Name] = m
+	}
+
+	target, ok := byName[targetName]
+	if targetName != "" && !ok {
+		return nil, fmt.Errorf("rollback target %s is not a known migration", targetName)
+	}
+
+	namespaces := migrationNamespaces(migrations)
+	inScope := func(name string) bool {
+		if IsRepeatableName(name) {
+			return false
+		}
+
+		if targetName == "" {
+			return true
+		}
+
+		return namespaceOf(name, namespaces) == target.Namespace && CompareNames(name, targetName) > 0
+	}
+
+	appliedNames := make(map[string]bool, len(applied))
+	for _, a := range applied {
+		appliedNames[a.Name] = true
+
+		if _, ok := byName[a.Name]; !ok && inScope(a.Name) {
+			return nil, fmt.Errorf("cannot rollback %s, no migration file found", a.Name)
+		}
+	}
+
+	// migrations are reverted in the reverse of the order they run, so
+	// sources are reverted before the sources they require
+	var out []Migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if !appliedNames[m.Name] || !inScope(m.Name) {
+			continue
+		}
+
+		if m.DownSQL == "" && m.DownFunc == nil {
+			return nil, fmt.Errorf("cannot rollback %s, no down migration found", m.Name)
+		}
+
+		out = append(out, m)
+	}
+
+	return out, nil
+}
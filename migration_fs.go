@@ -3,39 +3,166 @@ package trek
 import (
 	"fmt"
 	"io/fs"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
+const (
+	upSuffix         = ".up.sql"
+	downSuffix       = ".down.sql"
+	repeatablePrefix = "R__"
+)
+
+// GetMigrations loads every .sql file in from as a Migration. Files named
+// NNN_name.up.sql and NNN_name.down.sql are paired into a single Migration
+// named NNN_name.sql, plain .sql files are treated as up-only migrations.
+// Files named R__name.sql are repeatable migrations. Migrations are ordered by
+// the version parsed from their name, see ParseVersion, and two files with the
+// same version in one directory are an error.
+//
+// Names are the paths of the files in from, so adding files never renames
+// existing migrations. Use GetMigrationsIn to name migrations independently
+// of where their directory is embedded.
 func GetMigrations(from fs.FS) ([]Migration, error) {
-	var migrations []Migration
+	return GetMigrationsIn(from, ".")
+}
 
-	err := fs.WalkDir(from, ".", func(path string, d fs.DirEntry, err error) error {
-		// cannot happen
+// GetMigrationsIn loads the migrations in the directory root of from, as
+// GetMigrations does, naming them relative to root. `//go:embed schema` read
+// with GetMigrationsIn(schema, "schema") and fs.Sub(schema, "schema") read
+// with GetMigrations both name schema/01_init.sql 01_init.sql. The full path
+// is kept as an alias, so histories recorded under it keep working.
+func GetMigrationsIn(from fs.FS, root string) ([]Migration, error) {
+	root = path.Clean(root)
+
+	var paths []string
+	err := fs.WalkDir(from, root, func(path string, d fs.DirEntry, err error) error {
+		// root is missing or unreadable
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		if d.IsDir() {
 			return nil
 		}
 
-		b, err := fs.ReadFile(from, path)
-		if err != nil {
-			return err // or panic or ignore
-		}
-
 		ext := filepath.Ext(path)
 		if ext != ".sql" {
 			return fmt.Errorf("file not ending in .sql found in migrations: %s", path)
 		}
 
-		migrations = append(migrations, Migration{
-			Name: path,
-			SQL:  string(b),
-		})
+		paths = append(paths, path)
 
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*Migration)
+	var downOnly []string
+	for _, p := range paths {
+		b, err := fs.ReadFile(from, p)
+		if err != nil {
+			return nil, err
+		}
+
+		fullName, isDown := migrationName(p)
+		name := strings.TrimPrefix(fullName, root+"/")
+
+		m, ok := byName[name]
+		if !ok {
+			m = &Migration{Name: name, Repeatable: IsRepeatableName(name)}
+			if fullName != name {
+				m.Aliases = []string{fullName}
+			}
+			byName[name] = m
+		}
+
+		if isDown && m.Repeatable {
+			return nil, fmt.Errorf("repeatable migrations cannot be rolled back: %s", p)
+		}
+
+		if isDown {
+			if m.DownSQL != "" {
+				return nil, fmt.Errorf("duplicate down migration found for %s: %s", name, p)
+			}
+			m.DownSQL = string(b)
+			if m.SQL == "" {
+				downOnly = append(downOnly, name)
+			}
+			continue
+		}
+
+		if m.SQL != "" {
+			return nil, fmt.Errorf("duplicate up migration found for %s: %s", name, p)
+		}
+		m.SQL = string(b)
+		m.Replaces, _ = directiveArgs(m.SQL, ReplacesDirective)
+	}
+
+	for _, name := range downOnly {
+		if byName[name].SQL == "" {
+			return nil, fmt.Errorf("down migration found without a matching up migration: %s", name)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byName))
+	for _, m := range byName {
+		migrations = append(migrations, *m)
+	}
+
+	sortMigrations(migrations)
+
+	err = checkDuplicateVersions(migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	return migrations, nil
+}
+
+// sortMigrations orders versioned migrations by version, followed by
+// repeatable migrations by name. Namespaces keep the order they first appear in.
+func sortMigrations(migrations []Migration) {
+	namespaceRank := make(map[string]int)
+	for _, m := range migrations {
+		if _, ok := namespaceRank[m.Namespace]; !ok {
+			namespaceRank[m.Namespace] = len(namespaceRank)
+		}
+	}
+
+	sort.SliceStable(migrations, func(i, j int) bool {
+		a, b := migrations[i], migrations[j]
+		if a.Repeatable != b.Repeatable {
+			return !a.Repeatable
+		}
+
+		if a.Namespace != b.Namespace {
+			return namespaceRank[a.Namespace] < namespaceRank[b.Namespace]
+		}
+
+		return CompareNames(a.Name, b.Name) < 0
+	})
+}
+
+// IsRepeatableName reports whether a migration name is that of a repeatable
+// migration, R__name.sql
+func IsRepeatableName(name string) bool {
+	return strings.HasPrefix(path.Base(name), repeatablePrefix)
+}
 
-	return migrations, err
+// migrationName strips the .up/.down qualifier from path so both halves of a
+// pair share one name
+func migrationName(path string) (name string, isDown bool) {
+	switch {
+	case strings.HasSuffix(path, downSuffix):
+		return strings.TrimSuffix(path, downSuffix) + ".sql", true
+	case strings.HasSuffix(path, upSuffix):
+		return strings.TrimSuffix(path, upSuffix) + ".sql", false
+	default:
+		return path, false
+	}
 }
@@ -0,0 +1,158 @@
+package trek
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrMigrationLocked is returned when the migration lock is held by another
+// instance and the caller asked not to skip or wait, see FailIfLocked
+var ErrMigrationLocked = errors.New("migration lock held by another instance")
+
+// ErrMigrationLockTimeout is returned when WaitForLock times out before the
+// migration lock is released
+var ErrMigrationLockTimeout = errors.New("timed out waiting for migration lock")
+
+// ErrMigrationLockLost is returned when a lease on the migration lock ran out
+// and another instance took it over, or it was released with ForceUnlock,
+// while migrating. The migration running at the time is not recorded.
+var ErrMigrationLockLost = errors.New("migration lock lost while migrating")
+
+// MigrationTimeoutError is returned when a migration is cancelled for running
+// longer than WithMigrationTimeout allows
+type MigrationTimeoutError struct {
+	Name    string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *MigrationTimeoutError) Error() string {
+	return fmt.Sprintf("migration %s timed out after %s: %s", e.Name, e.Timeout, e.Err)
+}
+
+func (e *MigrationTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// MigrateOptions configure how a MigratableDB applies migrations
+type MigrateOptions struct {
+	// AllowOutOfOrder applies migrations missing from the history even when
+	// later migrations have already been applied
+	AllowOutOfOrder bool
+
+	// LockTimeout, when set, waits up to LockTimeout for another instance
+	// holding the migration lock to finish instead of returning immediately
+	LockTimeout time.Duration
+
+	// FailIfLocked returns ErrMigrationLocked instead of nil when the
+	// migration lock is held and LockTimeout is not set
+	FailIfLocked bool
+
+	// MigrationTimeout, when set, cancels any single migration that runs
+	// longer than MigrationTimeout
+	MigrationTimeout time.Duration
+
+	// TemplateData, when set, renders every migration as a text/template
+	// with TemplateData before it is checksummed or run
+	TemplateData interface{}
+
+	// Plan, when set, is called with the pending migrations in the order
+	// they would run, and no migrations are run
+	Plan func([]Migration) error
+
+	// AppVersion is recorded in the history with every migration applied
+	AppVersion string
+
+	// InstanceID is recorded in the history with every migration applied,
+	// it defaults to the hostname
+	InstanceID string
+}
+
+// A MigrateOption configures a call to Migrate
+type MigrateOption func(*MigrateOptions)
+
+// AllowOutOfOrder applies migrations that sort before the latest applied
+// migration, such as those merged from a long-lived branch, instead of
+// refusing to migrate
+func AllowOutOfOrder() MigrateOption {
+	return func(o *MigrateOptions) {
+		o.AllowOutOfOrder = true
+	}
+}
+
+// WaitForLock makes an instance that cannot take the migration lock wait up
+// to timeout for the instance holding it to finish, then apply anything still
+// pending. If timeout passes first Migrate returns ErrMigrationLockTimeout.
+// Without WaitForLock, Migrate returns nil as soon as it sees the lock is held.
+func WaitForLock(timeout time.Duration) MigrateOption {
+	return func(o *MigrateOptions) {
+		o.LockTimeout = timeout
+	}
+}
+
+// WithMigrationTimeout cancels any single migration that runs longer than
+// timeout, returning a *MigrationTimeoutError naming it
+func WithMigrationTimeout(timeout time.Duration) MigrateOption {
+	return func(o *MigrateOptions) {
+		o.MigrationTimeout = timeout
+	}
+}
+
+// FailIfLocked makes Migrate return ErrMigrationLocked when another instance
+// holds the migration lock, instead of returning nil
+func FailIfLocked() MigrateOption {
+	return func(o *MigrateOptions) {
+		o.FailIfLocked = true
+	}
+}
+
+// WithTemplateData renders migrations as text/templates with data, see
+// RenderMigrations
+func WithTemplateData(data interface{}) MigrateOption {
+	return func(o *MigrateOptions) {
+		o.TemplateData = data
+	}
+}
+
+// DryRun writes the pending migrations and their SQL to w instead of running
+// them, see WritePlan
+func DryRun(w io.Writer) MigrateOption {
+	return func(o *MigrateOptions) {
+		o.Plan = func(migrations []Migration) error {
+			return WritePlan(w, migrations)
+		}
+	}
+}
+
+// WithAppVersion records version, such as a release tag or commit, in the
+// history with every migration applied
+func WithAppVersion(version string) MigrateOption {
+	return func(o *MigrateOptions) {
+		o.AppVersion = version
+	}
+}
+
+// WithInstanceID records id in the history with every migration applied, in
+// place of the hostname, for environments where hostnames are not meaningful
+func WithInstanceID(id string) MigrateOption {
+	return func(o *MigrateOptions) {
+		o.InstanceID = id
+	}
+}
+
+func newMigrateOptions(opts []MigrateOption) MigrateOptions {
+	var o MigrateOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.InstanceID == "" {
+		// an unknown hostname is recorded as empty rather than failing
+		o.InstanceID, _ = os.Hostname()
+	}
+
+	return o
+}
@@ -0,0 +1,68 @@
+package trek
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fortytw2/lounge"
+)
+
+// Plan takes the migration lock and reads the migration history exactly as
+// Migrate would, returning the migrations Migrate would run, in order,
+// without running them
+func Plan(db MigratableDB, log lounge.Log, allMigrations []Migration, opts ...MigrateOption) ([]Migration, error) {
+	return PlanContext(context.Background(), db, log, allMigrations, opts...)
+}
+
+// PlanContext is Plan with a context
+func PlanContext(ctx context.Context, db MigratableDB, log lounge.Log, allMigrations []Migration, opts ...MigrateOption) ([]Migration, error) {
+	var planned []Migration
+	opts = append(opts, func(o *MigrateOptions) {
+		o.Plan = func(migrations []Migration) error {
+			planned = migrations
+			return nil
+		}
+	})
+
+	o := newMigrateOptions(opts)
+
+	allMigrations, err := prepareMigrations(allMigrations, o)
+	if err == nil {
+		err = db.ApplyMigrations(ctx, log, allMigrations, o)
+	}
+	if err != nil {
+		log.Errorf("cannot plan migrations: %s", err)
+		return nil, err
+	}
+
+	return planned, nil
+}
+
+// WritePlan writes each migration and the SQL it would run to w
+func WritePlan(w io.Writer, migrations []Migration) error {
+	if len(migrations) == 0 {
+		_, err := fmt.Fprintln(w, "-- no pending migrations")
+		return err
+	}
+
+	for i, m := range migrations {
+		_, err := fmt.Fprintf(w, "-- migration %d/%d: %s\n", i+1, len(migrations), m.Name)
+		if err != nil {
+			return err
+		}
+
+		body := strings.TrimRight(m.SQL, "\n")
+		if m.IsGo() {
+			body = "-- runs go code"
+		}
+
+		_, err = fmt.Fprintf(w, "%s\n\n", body)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -3,93 +3,195 @@ package postgresql
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
+	"time"
 
 	"github.com/fortytw2/lounge"
 	"github.com/fortytw2/trek"
+	"github.com/fortytw2/trek/internal/migrator"
+	"github.com/lib/pq"
 )
 
-func (w *Wrapper) ApplyMigrations(log lounge.Log, migrations []trek.Migration) error {
-	conn, err := w.db.Conn(context.Background())
+// lockPollInterval is how often a waiting migrator retries the migration lock
+const lockPollInterval = 250 * time.Millisecond
+
+func (w *Wrapper) ApplyMigrations(ctx context.Context, log lounge.Log, migrations []trek.Migration, opts trek.MigrateOptions) error {
+	return w.withMigrationLock(ctx, log, opts, func(m *migrator.Migrator) error {
+		return m.Apply(ctx, migrations, opts)
+	})
+}
+
+func (w *Wrapper) RollbackMigrations(ctx context.Context, log lounge.Log, migrations []trek.Migration, targetName string) error {
+	return w.withMigrationLock(ctx, log, trek.MigrateOptions{FailIfLocked: true}, func(m *migrator.Migrator) error {
+		return m.Rollback(ctx, migrations, targetName)
+	})
+}
+
+func (w *Wrapper) RepairMigrations(ctx context.Context, log lounge.Log, migrations []trek.Migration) error {
+	return w.withMigrationLock(ctx, log, trek.MigrateOptions{FailIfLocked: true}, func(m *migrator.Migrator) error {
+		return m.Repair(ctx, migrations)
+	})
+}
+
+// BaselineMigrations records migrations as applied without running them,
+// skipping any already in the history
+func (w *Wrapper) BaselineMigrations(ctx context.Context, migrations []trek.Migration, opts trek.MigrateOptions) error {
+	return w.withMigrationLock(ctx, w.log, opts, func(m *migrator.Migrator) error {
+		return m.Baseline(ctx, migrations, opts)
+	})
+}
+
+// AppliedMigrations returns the migration history, without taking the
+// migration lock or upgrading the history table
+func (w *Wrapper) AppliedMigrations(ctx context.Context) ([]trek.AppliedMigration, error) {
+	return w.history().AppliedMigrations(ctx, w.db)
+}
+
+// withMigrationLock runs fn on a connection holding the migration advisory lock
+// with the system tables in place, dry runs leave the tables as they are and
+// read a missing history as empty. If the lock is already held fn is not run,
+// unless opts.LockTimeout is set, in which case the lock is polled for until
+// opts.LockTimeout passes and trek.ErrMigrationLockTimeout is returned.
+//
+// The lock is always released with a fresh context, so a cancelled ctx cannot
+// return a connection still holding the lock to the pool, and a connection
+// whose unlock failed is closed rather than returned.
+func (w *Wrapper) withMigrationLock(ctx context.Context, log lounge.Log, opts trek.MigrateOptions, fn func(m *migrator.Migrator) error) (err error) {
+	conn, err := w.db.Conn(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	lockedThisSession, err := w.lock(conn)
+	lockedThisSession, err := w.lock(ctx, conn)
 	if err != nil {
 		return err
 	}
 
-	if !lockedThisSession {
+	if !lockedThisSession && opts.LockTimeout == 0 {
+		if opts.FailIfLocked {
+			return trek.ErrMigrationLocked
+		}
+
 		log.Infof("migrations lock already held, not running migrations")
 		return nil
 	}
 
-	err = verifySystemTables(conn)
-	if err != nil {
-		return err
-	}
+	if !lockedThisSession {
+		log.Infof("migrations lock already held, waiting up to %s for it to be released", opts.LockTimeout)
 
-	latestMigrationName, err := w.getLatestMigrationName()
-	if err != nil {
-		return err
-	}
+		waitCtx, cancel := context.WithTimeout(ctx, opts.LockTimeout)
+		defer cancel()
 
-	if latestMigrationName == "" {
-		log.Infof("no previous migrations found, running all")
-	} else {
-		log.Infof("last migration found: %s", latestMigrationName)
-	}
+		for !lockedThisSession {
+			select {
+			case <-waitCtx.Done():
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return trek.ErrMigrationLockTimeout
+			case <-time.After(lockPollInterval):
+			}
 
-	migrationsToRun := trek.GetMigrationsAfter(migrations, latestMigrationName)
+			lockedThisSession, err = w.lock(ctx, conn)
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Infof("acquired migrations lock, checking for pending migrations")
+	}
 
 	defer func() {
-		var err2 error
 		ok, err2 := w.unlock(conn)
 		if !ok {
-			log.Infof("did not successfully unlock db, you may need to run manually release any locks held on the db")
+			log.Errorf("did not successfully unlock db, inspect the holder with trek.CurrentLockHolder and release it with trek.ForceUnlock")
 		}
 		if err2 != nil {
-			err = fmt.Errorf("%s: %s", err, err2)
-		}
-	}()
+			// the session may still hold the lock, closing it releases the lock
+			discard(conn)
 
-	for i, m := range migrationsToRun {
-		log.Infof("running migration: %s", m.Name)
-		err := runMigration(i, m.SQL, conn)
-		if err != nil {
-			return err
+			if err == nil {
+				err = err2
+			} else {
+				err = fmt.Errorf("%w: %s", err, err2)
+			}
 		}
+	}()
 
-		err = recordMigration(m.Name, conn)
+	// a dry run changes no tables, a missing history reads as empty
+	if opts.Plan == nil {
+		err = w.verifySystemTables(ctx, conn)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return fn(&migrator.Migrator{Conn: conn, Log: log, History: w.history(), Dialect: trek.DialectPostgres})
 }
 
-func (w *Wrapper) getLatestMigrationName() (string, error) {
-	row := w.db.QueryRowContext(context.Background(), `
-	SELECT name FROM trek_migrations ORDER BY name DESC LIMIT 1
-	`)
+// holderQuery selects the session holding the advisory lock $1, whose 64 bit
+// key pg_locks splits across classid and objid
+const holderQuery = `
+	SELECT l.pid, coalesce(host(a.client_addr), a.application_name, ''), a.backend_start
+	FROM pg_locks l
+	JOIN pg_stat_activity a ON a.pid = l.pid
+	WHERE l.locktype = 'advisory'
+	AND l.granted
+	AND l.objsubid = 1
+	AND ((l.classid::bigint << 32) | l.objid::bigint) = $1
+`
 
-	var name string
-	err := row.Scan(&name)
+// MigrationLockHolder returns the session holding the migration advisory lock,
+// or nil. Advisory locks are released when their session ends, so the holder
+// has no lease and its Owner is the backend pid.
+func (w *Wrapper) MigrationLockHolder(ctx context.Context) (*trek.LockHolder, error) {
+	row := w.db.QueryRowContext(ctx, holderQuery, w.migrationAdvisoryLock)
+
+	var pid int
+	var holder trek.LockHolder
+	err := row.Scan(&pid, &holder.Host, &holder.AcquiredAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", nil
-		}
+		return nil, err
+	}
 
-		return "", err
+	holder.Owner = fmt.Sprintf("pid %d", pid)
+
+	return &holder, nil
+}
+
+// ForceUnlockMigrations terminates the session holding the migration advisory
+// lock, rolling back the migration it is running, for sessions left hanging
+// by a stuck client or connection pooler
+func (w *Wrapper) ForceUnlockMigrations(ctx context.Context) error {
+	_, err := w.db.ExecContext(ctx, `SELECT pg_terminate_backend(pid) FROM (`+holderQuery+`) holder`, w.migrationAdvisoryLock)
+	return err
+}
+
+// migrationsTable returns the quoted, schema qualified, history table name
+func (w *Wrapper) migrationsTable() string {
+	return w.qualify(w.migrationsTableName)
+}
+
+// seedsTable returns the quoted, schema qualified, seeds table name
+func (w *Wrapper) seedsTable() string {
+	return w.qualify(w.seedsTableName)
+}
+
+func (w *Wrapper) qualify(table string) string {
+	if w.migrationsSchema == "" {
+		return pq.QuoteIdentifier(table)
 	}
 
-	return name, nil
+	return pq.QuoteIdentifier(w.migrationsSchema) + "." + pq.QuoteIdentifier(table)
 }
 
-func (w *Wrapper) lock(c *sql.Conn) (bool, error) {
-	row := c.QueryRowContext(context.Background(), "SELECT pg_try_advisory_lock($1);", w.migrationAdvisoryLock)
+func (w *Wrapper) lock(ctx context.Context, c *sql.Conn) (bool, error) {
+	row := c.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1);", w.migrationAdvisoryLock)
 
 	var locked bool
 	err := row.Scan(&locked)
@@ -104,34 +206,55 @@ func (w *Wrapper) unlock(c *sql.Conn) (bool, error) {
 	return locked, err
 }
 
-func verifySystemTables(conn *sql.Conn) error {
-	_, err := conn.ExecContext(context.Background(), `
+// discard closes the session of conn instead of returning it to the pool
+func discard(conn *sql.Conn) {
+	_ = conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+}
+
+func (w *Wrapper) verifySystemTables(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `
 	CREATE EXTENSION IF NOT EXISTS pgcrypto;
 	`)
 	if err != nil {
 		return err
 	}
 
-	_, err = conn.ExecContext(context.Background(), `
-	CREATE TABLE IF NOT EXISTS trek_migrations (
+	if w.migrationsSchema != "" {
+		_, err = conn.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS `+pq.QuoteIdentifier(w.migrationsSchema))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS `+w.migrationsTable()+` (
 		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
 		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-		name TEXT NOT NULL UNIQUE
+		name TEXT NOT NULL UNIQUE,
+		checksum TEXT NOT NULL DEFAULT '',
+		duration_ms BIGINT NOT NULL DEFAULT 0,
+		host TEXT NOT NULL DEFAULT '',
+		app_version TEXT NOT NULL DEFAULT ''
 	)
 	`)
 	if err != nil {
 		return err
 	}
 
-	return err
-}
-
-func runMigration(num int, s string, db *sql.Conn) error {
-	_, err := db.ExecContext(context.Background(), s)
-	return err
-}
+	// upgrade history tables created before checksums, durations, hosts and
+	// app versions were recorded
+	_, err = conn.ExecContext(ctx, `
+	ALTER TABLE `+w.migrationsTable()+`
+		ADD COLUMN IF NOT EXISTS checksum TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS duration_ms BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS host TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS app_version TEXT NOT NULL DEFAULT ''
+	`)
+	if err != nil {
+		return err
+	}
 
-func recordMigration(name string, db *sql.Conn) error {
-	_, err := db.ExecContext(context.Background(), "INSERT INTO trek_migrations (name) VALUES ($1);", name)
 	return err
 }
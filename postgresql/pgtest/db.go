@@ -8,6 +8,7 @@ import (
 
 	"github.com/fortytw2/dockertest"
 	"github.com/fortytw2/lounge"
+	"github.com/fortytw2/trek/internal/golden"
 	"github.com/fortytw2/trek/postgresql"
 )
 
@@ -16,7 +17,7 @@ type DB struct {
 	container *dockertest.Container
 }
 
-func NewDB(t *testing.T, log lounge.Log) *DB {
+func NewDB(t *testing.T, log lounge.Log, opts ...postgresql.Option) *DB {
 	existingDSN, useEnvDB := os.LookupEnv("POSTGRES_DSN")
 
 	// may be nil
@@ -25,7 +26,7 @@ func NewDB(t *testing.T, log lounge.Log) *DB {
 	var db *postgresql.Wrapper
 	var err error
 	if useEnvDB {
-		db, err = postgresql.NewWrapper(existingDSN, log)
+		db, err = postgresql.NewWrapper(existingDSN, log, opts...)
 		if err != nil {
 			t.Fatalf("%s", err.Error())
 		}
@@ -42,7 +43,7 @@ func NewDB(t *testing.T, log lounge.Log) *DB {
 			t.Fatalf("%s", err.Error())
 		}
 
-		db, err = postgresql.NewWrapper("postgres://postgres:postgres@"+container.Addr+"?sslmode=disable", log)
+		db, err = postgresql.NewWrapper("postgres://postgres:postgres@"+container.Addr+"?sslmode=disable", log, opts...)
 		if err != nil {
 			t.Fatalf("%s", err.Error())
 		}
@@ -77,3 +78,17 @@ func (db *DB) Truncate(t *testing.T) {
 		t.Fatalf("could not truncate db: %s", err)
 	}
 }
+
+// AssertSchema fails the test if the schema of the database, usually after
+// trek.Migrate, does not match goldenFile. Run tests with TREK_UPDATE_GOLDEN=1
+// to rewrite goldenFile with the current schema.
+func (db *DB) AssertSchema(t *testing.T, goldenFile string) {
+	t.Helper()
+
+	schema, err := db.DumpSchema(context.Background())
+	if err != nil {
+		t.Fatalf("could not dump schema: %s", err)
+	}
+
+	golden.Assert(t, goldenFile, schema)
+}
@@ -0,0 +1,319 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/fortytw2/trek"
+	"github.com/lib/pq"
+)
+
+func init() {
+	var _ trek.SchemaDumper = &Wrapper{}
+}
+
+// userObjects restricts a pg_class / pg_proc / pg_type query aliased with
+// namespace n to objects created by users, not by postgres or an extension
+const userObjects = `
+	n.nspname NOT IN ('pg_catalog', 'information_schema')
+	AND n.nspname NOT LIKE 'pg\_toast%'
+	AND n.nspname NOT LIKE 'pg\_temp%'
+`
+
+// DumpSchema returns DDL recreating the schemas, extensions, enum types,
+// sequences, tables, constraints, indexes, functions, views and triggers of
+// the database, read from pg_catalog and ordered by schema and name, views
+// after the views they select from. trek's own tables are left out and
+// schemas are created IF NOT EXISTS, as trek creates the migrations schema
+// before running a baseline made from the dump.
+//
+// Objects of one kind are created together, so a column default calling a
+// user function or a function reading a view cannot be run back, move such
+// objects into a migration after the baseline.
+func (w *Wrapper) DumpSchema(ctx context.Context) (string, error) {
+	conn, err := w.db.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	var statements []string
+	for _, dump := range []func(context.Context, *sql.Conn) ([]string, error){
+		w.dumpSchemas,
+		w.dumpExtensions,
+		w.dumpEnums,
+		w.dumpSequences,
+		w.dumpTables,
+		w.dumpSequenceOwners,
+		w.dumpConstraints,
+		w.dumpIndexes,
+		w.dumpFunctions,
+		w.dumpViews,
+		w.dumpTriggers,
+	} {
+		s, err := dump(ctx, conn)
+		if err != nil {
+			return "", err
+		}
+
+		statements = append(statements, s...)
+	}
+
+	return trek.JoinSchema(statements), nil
+}
+
+// excludedTables are the trek tables left out of schema dumps, as a
+// comparable list of regclass names
+func (w *Wrapper) excludedTables() []string {
+	return []string{w.migrationsTable(), w.seedsTable()}
+}
+
+func (w *Wrapper) dumpSchemas(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	return queryStatements(ctx, conn, `
+	SELECT 'CREATE SCHEMA IF NOT EXISTS ' || quote_ident(n.nspname)
+	FROM pg_namespace n
+	WHERE `+userObjects+`
+	AND n.nspname <> 'public'
+	AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = n.oid AND d.deptype = 'e')
+	ORDER BY n.nspname
+	`)
+}
+
+func (w *Wrapper) dumpExtensions(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	return queryStatements(ctx, conn, `
+	SELECT 'CREATE EXTENSION IF NOT EXISTS ' || quote_ident(e.extname)
+	FROM pg_extension e
+	WHERE e.extname <> 'plpgsql'
+	ORDER BY e.extname
+	`)
+}
+
+func (w *Wrapper) dumpEnums(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	return queryStatements(ctx, conn, `
+	SELECT 'CREATE TYPE ' || quote_ident(n.nspname) || '.' || quote_ident(t.typname) || ' AS ENUM (' ||
+		string_agg(quote_literal(e.enumlabel), ', ' ORDER BY e.enumsortorder) || ')'
+	FROM pg_type t
+	JOIN pg_namespace n ON n.oid = t.typnamespace
+	JOIN pg_enum e ON e.enumtypid = t.oid
+	WHERE `+userObjects+`
+	AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = t.oid AND d.deptype = 'e')
+	GROUP BY n.nspname, t.typname
+	ORDER BY n.nspname, t.typname
+	`)
+}
+
+func (w *Wrapper) dumpSequences(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	// identity sequences are created by their column
+	return queryStatements(ctx, conn, `
+	SELECT 'CREATE SEQUENCE ' || quote_ident(n.nspname) || '.' || quote_ident(c.relname)
+		|| ' AS ' || format_type(s.seqtypid, NULL)
+		|| ' INCREMENT BY ' || s.seqincrement
+		|| ' MINVALUE ' || s.seqmin
+		|| ' MAXVALUE ' || s.seqmax
+		|| ' START WITH ' || s.seqstart
+		|| ' CACHE ' || s.seqcache
+		|| CASE WHEN s.seqcycle THEN ' CYCLE' ELSE '' END
+	FROM pg_class c
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	JOIN pg_sequence s ON s.seqrelid = c.oid
+	WHERE c.relkind = 'S'
+	AND `+userObjects+`
+	AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = c.oid AND d.deptype IN ('e', 'i'))
+	ORDER BY n.nspname, c.relname
+	`)
+}
+
+func (w *Wrapper) dumpSequenceOwners(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	// a sequence can only be owned by a column once its table exists
+	return queryStatements(ctx, conn, `
+	SELECT 'ALTER SEQUENCE ' || quote_ident(n.nspname) || '.' || quote_ident(c.relname)
+		|| ' OWNED BY ' || quote_ident(tn.nspname) || '.' || quote_ident(tc.relname) || '.' || quote_ident(a.attname)
+	FROM pg_class c
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	JOIN pg_depend d ON d.objid = c.oid AND d.classid = 'pg_class'::regclass AND d.refclassid = 'pg_class'::regclass AND d.deptype = 'a'
+	JOIN pg_class tc ON tc.oid = d.refobjid
+	JOIN pg_namespace tn ON tn.oid = tc.relnamespace
+	JOIN pg_attribute a ON a.attrelid = tc.oid AND a.attnum = d.refobjsubid
+	WHERE c.relkind = 'S'
+	AND `+userObjects+`
+	AND tc.oid <> ALL (SELECT to_regclass(t)::oid FROM unnest($1::text[]) t WHERE to_regclass(t) IS NOT NULL)
+	ORDER BY n.nspname, c.relname
+	`, pq.Array(w.excludedTables()))
+}
+
+func (w *Wrapper) dumpTables(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, `
+	SELECT c.oid, quote_ident(n.nspname) || '.' || quote_ident(c.relname)
+	FROM pg_class c
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind IN ('r', 'p')
+	AND `+userObjects+`
+	AND c.oid <> ALL (SELECT to_regclass(t)::oid FROM unnest($1::text[]) t WHERE to_regclass(t) IS NOT NULL)
+	AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = c.oid AND d.deptype = 'e')
+	ORDER BY n.nspname, c.relname
+	`, pq.Array(w.excludedTables()))
+	if err != nil {
+		return nil, err
+	}
+
+	type table struct {
+		oid  int64
+		name string
+	}
+
+	var tables []table
+	for rows.Next() {
+		var t table
+		err = rows.Scan(&t.oid, &t.name)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	rows.Close()
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []string
+	for _, t := range tables {
+		columns, err := queryStatements(ctx, conn, `
+		SELECT '    ' || quote_ident(a.attname) || ' ' || format_type(a.atttypid, a.atttypmod)
+			|| CASE
+				WHEN a.attidentity = 'a' THEN ' GENERATED ALWAYS AS IDENTITY'
+				WHEN a.attidentity = 'd' THEN ' GENERATED BY DEFAULT AS IDENTITY'
+				WHEN a.attgenerated = 's' THEN ' GENERATED ALWAYS AS (' || pg_get_expr(d.adbin, d.adrelid) || ') STORED'
+				WHEN d.adbin IS NOT NULL THEN ' DEFAULT ' || pg_get_expr(d.adbin, d.adrelid)
+				ELSE ''
+			END
+			|| CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END
+		FROM pg_attribute a
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attrelid = $1
+		AND a.attnum > 0
+		AND NOT a.attisdropped
+		ORDER BY a.attnum
+		`, t.oid)
+		if err != nil {
+			return nil, err
+		}
+
+		statements = append(statements, fmt.Sprintf("CREATE TABLE %s (\n%s\n)", t.name, strings.Join(columns, ",\n")))
+	}
+
+	return statements, nil
+}
+
+func (w *Wrapper) dumpConstraints(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	// constraints are added after every table exists so foreign keys never
+	// reference a table that has not been created yet
+	return queryStatements(ctx, conn, `
+	SELECT 'ALTER TABLE ' || quote_ident(n.nspname) || '.' || quote_ident(c.relname)
+		|| ' ADD CONSTRAINT ' || quote_ident(con.conname) || ' ' || pg_get_constraintdef(con.oid, true)
+	FROM pg_constraint con
+	JOIN pg_class c ON c.oid = con.conrelid
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE `+userObjects+`
+	AND con.contype IN ('p', 'u', 'f', 'c', 'x')
+	AND c.oid <> ALL (SELECT to_regclass(t)::oid FROM unnest($1::text[]) t WHERE to_regclass(t) IS NOT NULL)
+	ORDER BY n.nspname, c.relname, CASE con.contype WHEN 'p' THEN 0 WHEN 'u' THEN 1 WHEN 'c' THEN 2 ELSE 3 END, con.conname
+	`, pq.Array(w.excludedTables()))
+}
+
+func (w *Wrapper) dumpIndexes(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	// indexes backing a constraint are created by the constraint
+	return queryStatements(ctx, conn, `
+	SELECT pg_get_indexdef(i.indexrelid)
+	FROM pg_index i
+	JOIN pg_class ic ON ic.oid = i.indexrelid
+	JOIN pg_class c ON c.oid = i.indrelid
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE `+userObjects+`
+	AND NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = i.indexrelid AND con.contype IN ('p', 'u', 'x'))
+	AND c.oid <> ALL (SELECT to_regclass(t)::oid FROM unnest($1::text[]) t WHERE to_regclass(t) IS NOT NULL)
+	ORDER BY n.nspname, c.relname, ic.relname
+	`, pq.Array(w.excludedTables()))
+}
+
+func (w *Wrapper) dumpViews(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	// a view's depth is the length of the longest chain of views it selects
+	// from, so every view is created after the views it depends on
+	return queryStatements(ctx, conn, `
+	WITH RECURSIVE view_deps AS (
+		SELECT DISTINCT r.ev_class AS view, d.refobjid AS ref
+		FROM pg_rewrite r
+		JOIN pg_depend d ON d.classid = 'pg_rewrite'::regclass AND d.objid = r.oid
+		WHERE d.refclassid = 'pg_class'::regclass
+		AND d.refobjid <> r.ev_class
+	), depths AS (
+		SELECT c.oid, 0 AS depth
+		FROM pg_class c
+		WHERE c.relkind IN ('v', 'm')
+		UNION ALL
+		SELECT view_deps.view, depths.depth + 1
+		FROM depths
+		JOIN view_deps ON view_deps.ref = depths.oid
+	)
+	SELECT CASE c.relkind WHEN 'm' THEN 'CREATE MATERIALIZED VIEW ' ELSE 'CREATE VIEW ' END
+		|| quote_ident(n.nspname) || '.' || quote_ident(c.relname) || ' AS' || chr(10)
+		|| rtrim(pg_get_viewdef(c.oid, true), ';')
+		|| CASE c.relkind WHEN 'm' THEN chr(10) || 'WITH NO DATA' ELSE '' END
+	FROM pg_class c
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	JOIN (SELECT oid, max(depth) AS depth FROM depths GROUP BY oid) v ON v.oid = c.oid
+	WHERE `+userObjects+`
+	AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = c.oid AND d.deptype = 'e')
+	ORDER BY v.depth, n.nspname, c.relname
+	`)
+}
+
+func (w *Wrapper) dumpFunctions(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	return queryStatements(ctx, conn, `
+	SELECT pg_get_functiondef(p.oid)
+	FROM pg_proc p
+	JOIN pg_namespace n ON n.oid = p.pronamespace
+	WHERE `+userObjects+`
+	AND p.prokind IN ('f', 'p')
+	AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.objid = p.oid AND d.deptype = 'e')
+	ORDER BY n.nspname, p.proname, pg_get_function_identity_arguments(p.oid)
+	`)
+}
+
+func (w *Wrapper) dumpTriggers(ctx context.Context, conn *sql.Conn) ([]string, error) {
+	return queryStatements(ctx, conn, `
+	SELECT pg_get_triggerdef(t.oid, true)
+	FROM pg_trigger t
+	JOIN pg_class c ON c.oid = t.tgrelid
+	JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE NOT t.tgisinternal
+	AND `+userObjects+`
+	ORDER BY n.nspname, c.relname, t.tgname
+	`)
+}
+
+// queryStatements runs a query returning one statement per row
+func queryStatements(ctx context.Context, conn *sql.Conn, query string, args ...interface{}) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statements []string
+	for rows.Next() {
+		var stmt string
+		err = rows.Scan(&stmt)
+		if err != nil {
+			return nil, err
+		}
+
+		statements = append(statements, strings.TrimSpace(stmt))
+	}
+
+	return statements, rows.Err()
+}
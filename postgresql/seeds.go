@@ -0,0 +1,89 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fortytw2/lounge"
+	"github.com/fortytw2/trek"
+	"github.com/fortytw2/trek/internal/migrator"
+)
+
+// ApplySeeds runs every seed that is new or has changed since it was last
+// applied, each in a transaction with its record in the seeds table. Dry runs
+// hand those seeds to opts.Plan instead, leaving the seeds table as it is.
+func (w *Wrapper) ApplySeeds(ctx context.Context, log lounge.Log, seeds []trek.Seed, opts trek.MigrateOptions) error {
+	return w.withMigrationLock(ctx, log, opts, func(m *migrator.Migrator) error {
+		if opts.Plan != nil {
+			var exists bool
+			err := m.Conn.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, w.seedsTable()).Scan(&exists)
+			if err != nil {
+				return err
+			}
+
+			var applied []trek.AppliedMigration
+			if exists {
+				applied, err = w.getAppliedSeeds(ctx, m.Conn)
+				if err != nil {
+					return err
+				}
+			}
+
+			return opts.Plan(migrator.SeedMigrations(trek.GetPendingSeeds(seeds, applied)))
+		}
+
+		_, err := m.Conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS `+w.seedsTable()+` (
+			name TEXT PRIMARY KEY,
+			checksum TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+		`)
+		if err != nil {
+			return err
+		}
+
+		applied, err := w.getAppliedSeeds(ctx, m.Conn)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range trek.GetPendingSeeds(seeds, applied) {
+			log.Infof("applying seed: %s", s.Name)
+			err = migrator.Transact(ctx, m.Conn, true, func(db trek.StdlibDB) error {
+				err := trek.ExecStatements(ctx, db, s.SQL, trek.DialectPostgres)
+				if err != nil {
+					return err
+				}
+
+				_, err = db.ExecContext(ctx, `INSERT INTO `+w.seedsTable()+` (name, checksum) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET checksum = excluded.checksum, created_at = now();`, s.Name, s.Checksum())
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("seed %s failed: %w", s.Name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (w *Wrapper) getAppliedSeeds(ctx context.Context, db trek.StdlibDB) ([]trek.AppliedMigration, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name, checksum, created_at FROM `+w.seedsTable()+` ORDER BY name ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []trek.AppliedMigration
+	for rows.Next() {
+		var a trek.AppliedMigration
+		err = rows.Scan(&a.Name, &a.Checksum, &a.AppliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+
+	return applied, rows.Err()
+}
@@ -0,0 +1,8 @@
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+CREATE TABLE public.monkeys (
+    id integer NOT NULL,
+    name text NOT NULL
+);
+
+ALTER TABLE public.monkeys ADD CONSTRAINT monkeys_pkey PRIMARY KEY (id);
@@ -0,0 +1 @@
+DROP INDEX monkey_names;
@@ -0,0 +1,2 @@
+INSERT INTO monkeys (id, name) VALUES (1, 'bubbles'), (2, 'marcel')
+ON CONFLICT (id) DO UPDATE SET name = excluded.name;
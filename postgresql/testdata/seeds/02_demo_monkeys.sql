@@ -0,0 +1,3 @@
+-- trek:env dev
+INSERT INTO monkeys (id, name) VALUES (100, 'demo')
+ON CONFLICT (id) DO UPDATE SET name = excluded.name;
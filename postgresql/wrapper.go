@@ -4,10 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"hash/fnv"
 	"time"
 
 	"github.com/fortytw2/lounge"
 	"github.com/fortytw2/trek"
+	"github.com/fortytw2/trek/internal/migrator"
 
 	_ "github.com/lib/pq"
 )
@@ -16,18 +18,61 @@ func init() {
 	var _ trek.DB = &Wrapper{}
 }
 
-const defaultAdvisoryLock = 42069
+const (
+	defaultAdvisoryLock   = 42069
+	defaultMigrationTable = "trek_migrations"
+	defaultSeedsTable     = "trek_seeds"
+)
 
 type Wrapper struct {
 	log lounge.Log
 
-	migrationAdvisoryLock int
+	migrationAdvisoryLock int64
+	migrationsTableName   string
+	migrationsSchema      string
+	seedsTableName        string
 
 	db         *sql.DB
-	sqlWrapper *sqlWrapper
+	sqlWrapper *migrator.SQLWrapper
+}
+
+// An Option configures a Wrapper
+type Option func(*Wrapper)
+
+// WithMigrationsTable records migration history in table instead of
+// trek_migrations
+func WithMigrationsTable(table string) Option {
+	return func(w *Wrapper) {
+		w.migrationsTableName = table
+	}
+}
+
+// WithSeedsTable records applied seeds in table instead of trek_seeds
+func WithSeedsTable(table string) Option {
+	return func(w *Wrapper) {
+		w.seedsTableName = table
+	}
+}
+
+// WithMigrationsSchema keeps the migration history and seeds tables in schema,
+// creating it if needed, instead of the first schema on the search_path
+func WithMigrationsSchema(schema string) Option {
+	return func(w *Wrapper) {
+		w.migrationsSchema = schema
+	}
+}
+
+// WithAdvisoryLockKey overrides the advisory lock key used to serialize
+// migrations. By default the key is derived from the history table and schema,
+// so services migrating separate schemas of one database do not block each
+// other.
+func WithAdvisoryLockKey(key int64) Option {
+	return func(w *Wrapper) {
+		w.migrationAdvisoryLock = key
+	}
 }
 
-func NewWrapper(pgDSN string, log lounge.Log) (*Wrapper, error) {
+func NewWrapper(pgDSN string, log lounge.Log, opts ...Option) (*Wrapper, error) {
 	db, err := sql.Open("postgres", pgDSN)
 	if err != nil {
 		return nil, err
@@ -55,12 +100,36 @@ func NewWrapper(pgDSN string, log lounge.Log) (*Wrapper, error) {
 
 	log.Infof("postgresql version: %s", version)
 
-	return &Wrapper{
-		log:                   log,
-		db:                    db,
-		migrationAdvisoryLock: defaultAdvisoryLock,
-		sqlWrapper:            newSQLWrapper(log, db),
-	}, nil
+	w := &Wrapper{
+		log:                 log,
+		db:                  db,
+		migrationsTableName: defaultMigrationTable,
+		seedsTableName:      defaultSeedsTable,
+		sqlWrapper:          migrator.NewSQLWrapper(log, db),
+	}
+
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	if w.migrationAdvisoryLock == 0 {
+		w.migrationAdvisoryLock = advisoryLockKey(w.migrationsSchema, w.migrationsTableName)
+	}
+
+	return w, nil
+}
+
+// advisoryLockKey derives a migration lock key from the history table, keeping
+// the historical key for the default table so upgraded and not yet upgraded
+// instances still exclude each other
+func advisoryLockKey(schema, table string) int64 {
+	if schema == "" && table == defaultMigrationTable {
+		return defaultAdvisoryLock
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(schema + "." + table))
+	return int64(h.Sum64())
 }
 
 func (w *Wrapper) Query(ctx context.Context, scanner trek.ScanFn, query string, args ...interface{}) error {
@@ -82,7 +151,7 @@ func (w *Wrapper) Transact(ctx context.Context, txFn trek.TxFn) error {
 		return err
 	}
 
-	internalWrapper := newSQLWrapper(w.log, tx)
+	internalWrapper := migrator.NewSQLWrapper(w.log, tx)
 	err = txFn(internalWrapper)
 	if err != nil {
 		w.log.Errorf("error within tx execution, rolling back: %s", err)
@@ -1,20 +1,32 @@
 package postgresql_test
 
 import (
+	"bytes"
 	"context"
 	"embed"
+	"errors"
 	"os"
+	"strings"
 	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/fortytw2/lounge"
 	"github.com/fortytw2/trek"
+	"github.com/fortytw2/trek/postgresql"
 	"github.com/fortytw2/trek/postgresql/pgtest"
 )
 
 //go:embed testdata/schema1
 var schema embed.FS
 
+//go:embed testdata/schema2
+var reversibleSchema embed.FS
+
+//go:embed testdata/seeds
+var seedData embed.FS
+
 func TestPostgreSQL(t *testing.T) {
 	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
 
@@ -44,6 +56,25 @@ func TestPostgreSQL(t *testing.T) {
 	}
 }
 
+func TestPostgreSQLSchema(t *testing.T) {
+	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	db := pgtest.NewDB(t, l)
+	defer db.Shutdown()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trek.Migrate(db, l, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.AssertSchema(t, "testdata/schema1.golden.sql")
+}
+
 func TestPostgreSQLConcurrentMigrations(t *testing.T) {
 	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
 
@@ -82,3 +113,499 @@ func TestPostgreSQLConcurrentMigrations(t *testing.T) {
 		t.Error("did not get zero monkeys")
 	}
 }
+
+func TestPostgreSQLWaitForLock(t *testing.T) {
+	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	db := pgtest.NewDB(t, l)
+	defer db.Shutdown()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	migrations, err := trek.AddGoMigrations(nil, trek.Migration{
+		Name: "01_bananas.go",
+		Func: func(tx trek.DB) error {
+			err := tx.Exec(context.TODO(), `CREATE TABLE bananas (id integer primary key not null);`)
+			if err != nil {
+				return err
+			}
+
+			close(started)
+			<-release
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaderErr := make(chan error, 1)
+	go func() {
+		leaderErr <- trek.Migrate(db, l, migrations)
+	}()
+	<-started
+
+	err = trek.Migrate(db, l, migrations, trek.WaitForLock(500*time.Millisecond))
+	if !errors.Is(err, trek.ErrMigrationLockTimeout) {
+		t.Errorf("expected ErrMigrationLockTimeout, got %v", err)
+	}
+
+	followerErr := make(chan error, 1)
+	go func() {
+		followerErr <- trek.Migrate(db, l, migrations, trek.WaitForLock(time.Minute))
+	}()
+
+	// let the follower poll the held lock before the leader finishes
+	time.Sleep(500 * time.Millisecond)
+	close(release)
+
+	if err := <-leaderErr; err != nil {
+		t.Fatalf("leader failed: %s", err)
+	}
+
+	if err := <-followerErr; err != nil {
+		t.Fatalf("follower did not wait for the leader: %s", err)
+	}
+
+	applied, err := db.AppliedMigrations(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != 1 {
+		t.Errorf("expected the migration to be applied once, got %+v", applied)
+	}
+}
+
+func TestPostgreSQLRollback(t *testing.T) {
+	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	db := pgtest.NewDB(t, l)
+	defer db.Shutdown()
+
+	migrations, err := trek.GetMigrations(reversibleSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trek.Migrate(db, l, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trek.Rollback(db, l, migrations, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row := db.QueryRow(context.TODO(), "SELECT count(*) FROM information_schema.tables WHERE table_name = 'monkeys';")
+
+	var count int
+	err = row.Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Error("monkeys table was not rolled back")
+	}
+}
+
+func TestPostgreSQLMigrationsSchema(t *testing.T) {
+	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	db := pgtest.NewDB(t, l, postgresql.WithMigrationsSchema("billing"), postgresql.WithMigrationsTable("history"))
+	defer db.Shutdown()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trek.Migrate(db, l, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row := db.QueryRow(context.TODO(), "SELECT to_regclass('billing.history') IS NOT NULL;")
+
+	var exists bool
+	err = row.Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists {
+		t.Error("history table was not created in the billing schema")
+	}
+}
+
+func TestPostgreSQLForceUnlock(t *testing.T) {
+	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	db := pgtest.NewDB(t, l)
+	defer db.Shutdown()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	hung, err := trek.AddGoMigrations(nil, trek.Migration{
+		Name: "01_hung.go",
+		Func: func(tx trek.DB) error {
+			close(started)
+			<-release
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- trek.Migrate(db, l, hung)
+	}()
+	<-started
+
+	holder, err := trek.CurrentLockHolder(context.TODO(), db)
+	if err != nil || holder == nil {
+		t.Fatalf("expected a lock holder, got %v %v", holder, err)
+	}
+
+	err = trek.ForceUnlock(context.TODO(), db, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	// the terminated session cannot commit the migration
+	if err := <-errs; err == nil {
+		t.Error("expected the hung migration to fail")
+	}
+
+	holder, err = trek.CurrentLockHolder(context.TODO(), db)
+	if err != nil || holder != nil {
+		t.Errorf("expected no lock holder, got %v %v", holder, err)
+	}
+}
+
+// legacyHistory is the history table created before checksums and migration
+// metadata were recorded
+const legacyHistory = `
+CREATE TABLE trek_migrations (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	name TEXT NOT NULL UNIQUE
+);
+INSERT INTO trek_migrations (name) VALUES ('testdata/schema2/01_init.sql');
+`
+
+func TestPostgreSQLStatusLeavesHistoryUnchanged(t *testing.T) {
+	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	db := pgtest.NewDB(t, l)
+	defer db.Shutdown()
+
+	migrations, err := trek.GetMigrations(reversibleSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Exec(context.TODO(), legacyHistory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := trek.Status(context.TODO(), db, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Applied) != 1 || report.Applied[0].Checksum != "" || len(report.Pending) != 1 {
+		t.Errorf("unexpected status %+v", report)
+	}
+
+	if countColumns(t, db, "trek_migrations") != 3 {
+		t.Error("status changed the history table")
+	}
+}
+
+func TestPostgreSQLPlanChangesNothing(t *testing.T) {
+	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	db := pgtest.NewDB(t, l, postgresql.WithMigrationsSchema("planned"))
+	defer db.Shutdown()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	planned, err := trek.Plan(db, l, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(planned) != 1 {
+		t.Fatalf("unexpected plan %+v", planned)
+	}
+
+	row := db.QueryRow(context.TODO(), "SELECT to_regnamespace('planned') IS NULL AND to_regclass('trek_migrations') IS NULL")
+
+	var untouched bool
+	err = row.Scan(&untouched)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !untouched {
+		t.Error("plan created the migrations schema or history table")
+	}
+}
+
+func TestPostgreSQLMigrationMetadata(t *testing.T) {
+	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	db := pgtest.NewDB(t, l)
+	defer db.Shutdown()
+
+	migrations, err := trek.GetMigrations(reversibleSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 01_init.sql applied by a trek version that recorded no metadata
+	err = db.Exec(context.TODO(), legacyHistory+migrations[0].SQL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trek.Migrate(db, l, migrations, trek.WithAppVersion("v1.2.3"), trek.WithInstanceID("worker-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if countColumns(t, db, "trek_migrations") != 7 {
+		t.Error("history table was not upgraded")
+	}
+
+	applied, err := db.AppliedMigrations(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != 2 || applied[0].Checksum != migrations[0].Checksum() || applied[0].Host != "" {
+		t.Errorf("unexpected metadata for the legacy migration %+v", applied)
+	}
+
+	if applied[1].Host != "worker-1" || applied[1].AppVersion != "v1.2.3" || applied[1].Duration < 0 {
+		t.Errorf("unexpected metadata for the second migration %+v", applied[1])
+	}
+}
+
+func TestPostgreSQLSeeds(t *testing.T) {
+	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	db := pgtest.NewDB(t, l, postgresql.WithMigrationsSchema("seeded"))
+	defer db.Shutdown()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seeds, err := trek.GetSeedsIn(seedData, "testdata/seeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trek.Migrate(db, l, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trek.ApplySeeds(db, l, seeds, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countMonkeys(t, db); n != 2 {
+		t.Fatalf("expected 2 seeded monkeys in prod, got %d", n)
+	}
+
+	// seeds that already ran are skipped, dev only seeds run in dev
+	err = trek.ApplySeeds(db, l, seeds, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countMonkeys(t, db); n != 3 {
+		t.Fatalf("expected 3 seeded monkeys in dev, got %d", n)
+	}
+
+	// an edited seed runs again
+	seeds[0].SQL = "INSERT INTO monkeys (id, name) VALUES (3, 'abu') ON CONFLICT (id) DO NOTHING;"
+	err = trek.ApplySeeds(db, l, seeds, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countMonkeys(t, db); n != 4 {
+		t.Fatalf("expected the edited seed to run again, got %d monkeys", n)
+	}
+
+	row := db.QueryRow(context.TODO(), "SELECT count(*) FROM seeded.trek_seeds")
+
+	var recorded int
+	err = row.Scan(&recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if recorded != 2 {
+		t.Errorf("expected 2 seeds recorded in the migrations schema, got %d", recorded)
+	}
+}
+
+func TestPostgreSQLSeedsDryRun(t *testing.T) {
+	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	db := pgtest.NewDB(t, l)
+	defer db.Shutdown()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seeds, err := trek.GetSeedsIn(seedData, "testdata/seeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trek.Migrate(db, l, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var plan bytes.Buffer
+	err = trek.ApplySeeds(db, l, seeds, "dev", trek.DryRun(&plan))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(plan.String(), "-- migration 2/2: 02_demo_monkeys.sql") {
+		t.Errorf("unexpected seed plan\n%s", plan.String())
+	}
+
+	if n := countMonkeys(t, db); n != 0 {
+		t.Errorf("dry run applied seeds, got %d monkeys", n)
+	}
+
+	var untouched bool
+	err = db.QueryRow(context.TODO(), "SELECT to_regclass('trek_seeds') IS NULL").Scan(&untouched)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !untouched {
+		t.Error("dry run created the seeds table")
+	}
+}
+
+// squashedSchema creates objects a dump must order by dependency rather than
+// by name to run back
+const squashedSchema = `
+CREATE SCHEMA app;
+CREATE SEQUENCE app.ticket_numbers START WITH 100;
+CREATE TABLE app.tickets (
+	id integer PRIMARY KEY DEFAULT nextval('app.ticket_numbers'),
+	title text NOT NULL
+);
+ALTER SEQUENCE app.ticket_numbers OWNED BY app.tickets.id;
+CREATE FUNCTION app.shout(t text) RETURNS text LANGUAGE sql IMMUTABLE AS $$ SELECT upper(t) $$;
+CREATE VIEW app.b_open_tickets AS SELECT id, title FROM app.tickets;
+CREATE VIEW app.a_loud_tickets AS SELECT id, app.shout(title) AS title FROM app.b_open_tickets;
+`
+
+func TestPostgreSQLSquash(t *testing.T) {
+	l := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	db := pgtest.NewDB(t, l, postgresql.WithMigrationsSchema("squash"))
+	defer db.Shutdown()
+
+	migrations, err := trek.GetMigrations(fstest.MapFS{
+		"01_init.sql": {Data: []byte(squashedSchema)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseline, err := trek.Squash(context.TODO(), db, l, migrations, "01_init.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// start over from an empty database, which runs only the baseline
+	err = db.Exec(context.TODO(), "DROP SCHEMA app CASCADE; DROP SCHEMA squash CASCADE;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trek.Migrate(db, l, []trek.Migration{baseline})
+	if err != nil {
+		t.Fatalf("baseline did not run on a new database: %s\n%s", err, baseline.SQL)
+	}
+
+	row := db.QueryRow(context.TODO(), "INSERT INTO app.tickets (title) VALUES ('squashed') RETURNING id, pg_get_serial_sequence('app.tickets', 'id')")
+
+	var id int
+	var sequence string
+	err = row.Scan(&id, &sequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != 100 || sequence != "app.ticket_numbers" {
+		t.Errorf("sequence lost its start or owner, got id %d from %q", id, sequence)
+	}
+
+	row = db.QueryRow(context.TODO(), "SELECT title FROM app.a_loud_tickets WHERE id = $1", id)
+
+	var title string
+	err = row.Scan(&title)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if title != "SQUASHED" {
+		t.Errorf("got title %q from the view, want SQUASHED", title)
+	}
+}
+
+func countMonkeys(t *testing.T, db *pgtest.DB) int {
+	t.Helper()
+
+	row := db.QueryRow(context.TODO(), "SELECT count(*) FROM monkeys")
+
+	var count int
+	err := row.Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func countColumns(t *testing.T, db *pgtest.DB, table string) int {
+	t.Helper()
+
+	row := db.QueryRow(context.TODO(), "SELECT count(*) FROM information_schema.columns WHERE table_name = $1", table)
+
+	var count int
+	err := row.Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
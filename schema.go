@@ -0,0 +1,41 @@
+package trek
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// A SchemaDumper produces a deterministic, normalized snapshot of a database
+// schema as SQL, suitable for checking in and diffing in code review
+type SchemaDumper interface {
+	DumpSchema(context.Context) (string, error)
+}
+
+// WriteSchema dumps the schema of db to path, typically after Migrate, so the
+// effect of each migration shows up as a diff of a checked-in file
+func WriteSchema(ctx context.Context, db SchemaDumper, path string) error {
+	schema, err := db.DumpSchema(ctx)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, []byte(schema), 0644)
+}
+
+// JoinSchema joins statements into a schema dump, one statement per
+// paragraph, each terminated with a semicolon
+func JoinSchema(statements []string) string {
+	if len(statements) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	for _, stmt := range statements {
+		stmt = strings.TrimRight(strings.TrimSpace(stmt), ";")
+		sb.WriteString(stmt)
+		sb.WriteString(";\n\n")
+	}
+
+	return strings.TrimRight(sb.String(), "\n") + "\n"
+}
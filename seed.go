@@ -0,0 +1,155 @@
+package trek
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fortytw2/lounge"
+)
+
+// A Seed is a file of reference or demo data. Seeds run after migrations,
+// and again whenever their SQL changes, so they must be idempotent, e.g.
+// INSERT ... ON CONFLICT DO UPDATE.
+type Seed struct {
+	Name string
+	SQL  string
+
+	// Envs are the environments the seed runs in, from its
+	// `-- trek:env` directive, empty for every environment
+	Envs []string
+}
+
+// Checksum returns the hex encoded sha256 of the seed's SQL
+func (s Seed) Checksum() string {
+	sum := sha256.Sum256([]byte(s.SQL))
+	return hex.EncodeToString(sum[:])
+}
+
+// InEnv reports whether the seed runs in env
+func (s Seed) InEnv(env string) bool {
+	if len(s.Envs) == 0 {
+		return true
+	}
+
+	for _, e := range s.Envs {
+		if e == env {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetSeeds loads every .sql file in from as a Seed, ordered and named like
+// GetMigrations names migrations
+func GetSeeds(from fs.FS) ([]Seed, error) {
+	return GetSeedsIn(from, ".")
+}
+
+// GetSeedsIn loads the seeds in the directory root of from, naming them
+// relative to root like GetMigrationsIn
+func GetSeedsIn(from fs.FS, root string) ([]Seed, error) {
+	root = path.Clean(root)
+
+	var paths []string
+	err := fs.WalkDir(from, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		if filepath.Ext(path) != ".sql" {
+			return fmt.Errorf("file not ending in .sql found in seeds: %s", path)
+		}
+
+		paths = append(paths, path)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seeds := make([]Seed, 0, len(paths))
+	for _, p := range paths {
+		b, err := fs.ReadFile(from, p)
+		if err != nil {
+			return nil, err
+		}
+
+		envs, ok := directiveArgs(string(b), EnvDirective)
+		if ok && len(envs) == 0 {
+			return nil, fmt.Errorf("seed %s has a -- trek:%s directive without environments", p, EnvDirective)
+		}
+
+		seeds = append(seeds, Seed{
+			Name: strings.TrimPrefix(p, root+"/"),
+			SQL:  string(b),
+			Envs: envs,
+		})
+	}
+
+	sort.SliceStable(seeds, func(i, j int) bool {
+		return CompareNames(seeds[i].Name, seeds[j].Name) < 0
+	})
+
+	return seeds, nil
+}
+
+// FilterSeeds returns the seeds that run in env
+func FilterSeeds(seeds []Seed, env string) []Seed {
+	var out []Seed
+	for _, s := range seeds {
+		if s.InEnv(env) {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
+
+// GetPendingSeeds returns every seed that has not been applied, or has
+// changed since it was applied, in order
+func GetPendingSeeds(seeds []Seed, applied []AppliedMigration) []Seed {
+	checksums := make(map[string]string, len(applied))
+	for _, a := range applied {
+		checksums[a.Name] = a.Checksum
+	}
+
+	var pending []Seed
+	for _, s := range seeds {
+		if checksum, ok := checksums[s.Name]; !ok || checksum != s.Checksum() {
+			pending = append(pending, s)
+		}
+	}
+
+	return pending
+}
+
+// ApplySeeds applies the seeds that run in env and are new or have changed
+// since they were last applied, under the migration lock. Call it after
+// Migrate. With DryRun the seeds are written out instead of applied.
+func ApplySeeds(db MigratableDB, log lounge.Log, seeds []Seed, env string, opts ...MigrateOption) error {
+	return ApplySeedsContext(context.Background(), db, log, seeds, env, opts...)
+}
+
+// ApplySeedsContext is ApplySeeds with a context
+func ApplySeedsContext(ctx context.Context, db MigratableDB, log lounge.Log, seeds []Seed, env string, opts ...MigrateOption) error {
+	err := db.ApplySeeds(ctx, log, FilterSeeds(seeds, env), newMigrateOptions(opts))
+	if err != nil {
+		log.Errorf("cannot apply seeds: %s", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package trek_test
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/fortytw2/trek"
+)
+
+func TestGetSeeds(t *testing.T) {
+	seeds, err := trek.GetSeedsIn(fstest.MapFS{
+		"seeds/10_plans.sql":    {Data: []byte("-- trek:env dev test\nSELECT 1;")},
+		"seeds/9_countries.sql": {Data: []byte("SELECT 2;")},
+	}, "seeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seeds) != 2 || seeds[0].Name != "9_countries.sql" || seeds[1].Name != "10_plans.sql" {
+		t.Fatalf("unexpected seeds %+v", seeds)
+	}
+
+	if !reflect.DeepEqual(seeds[1].Envs, []string{"dev", "test"}) {
+		t.Errorf("got envs %v, want dev test", seeds[1].Envs)
+	}
+
+	if got := trek.FilterSeeds(seeds, "prod"); len(got) != 1 || got[0].Name != "9_countries.sql" {
+		t.Errorf("unexpected prod seeds %+v", got)
+	}
+
+	applied := []trek.AppliedMigration{
+		{Name: "9_countries.sql", Checksum: seeds[0].Checksum()},
+		{Name: "10_plans.sql", Checksum: "stale"},
+	}
+	if got := trek.GetPendingSeeds(seeds, applied); len(got) != 1 || got[0].Name != "10_plans.sql" {
+		t.Errorf("unexpected pending seeds %+v", got)
+	}
+
+	_, err = trek.GetSeeds(fstest.MapFS{"01_x.sql": {Data: []byte("-- trek:env\nSELECT 1;")}})
+	if err == nil {
+		t.Error("expected an error for an env directive without environments")
+	}
+}
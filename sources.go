@@ -0,0 +1,195 @@
+package trek
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// A Source is a named set of migrations, such as the embedded schema of one Go
+// module. Migrations from a source are named and ordered within the source's
+// namespace, e.g. `billing/01_init.sql`, so several sources can share one
+// history table.
+type Source struct {
+	Name string
+	FS   fs.FS
+
+	// Root is the directory of FS holding the migrations, which are named
+	// relative to it as by GetMigrationsIn, the root of FS if empty
+	Root string
+
+	// GoMigrations are merged into the migrations found in FS, their names
+	// are relative to the source like those of the files
+	GoMigrations []Migration
+
+	// Requires lists migrations of other sources that must be applied before
+	// any migration of this source runs
+	Requires []Requirement
+}
+
+// A Requirement names a migration of another source, e.g. "billing requires
+// auth up to 03_roles.sql" is Requirement{Source: "auth", UpTo: "03_roles.sql"}
+type Requirement struct {
+	Source string
+	UpTo   string
+}
+
+// GetMigrationsFromSources loads the migrations of every source, prefixing
+// each name with the source name and setting its Namespace. Sources are
+// ordered so that every Requirement runs first, otherwise in the order given.
+func GetMigrationsFromSources(sources ...Source) ([]Migration, error) {
+	byName := make(map[string]Source, len(sources))
+	for _, src := range sources {
+		if src.Name == "" || strings.Contains(src.Name, "/") {
+			return nil, fmt.Errorf("invalid migration source name %q", src.Name)
+		}
+
+		if _, ok := byName[src.Name]; ok {
+			return nil, fmt.Errorf("duplicate migration source: %s", src.Name)
+		}
+
+		byName[src.Name] = src
+	}
+
+	loaded := make(map[string][]Migration, len(sources))
+	for _, src := range sources {
+		migrations, err := GetMigrationsIn(src.FS, src.Root)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load migration source %s: %w", src.Name, err)
+		}
+
+		migrations, err = AddGoMigrations(migrations, src.GoMigrations...)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load migration source %s: %w", src.Name, err)
+		}
+
+		loaded[src.Name] = migrations
+	}
+
+	for _, src := range sources {
+		for _, req := range src.Requires {
+			required, ok := loaded[req.Source]
+			if !ok {
+				return nil, fmt.Errorf("migration source %s requires unknown source %s", src.Name, req.Source)
+			}
+
+			if !containsMigration(required, req.UpTo) {
+				return nil, fmt.Errorf("migration source %s requires unknown migration %s/%s", src.Name, req.Source, req.UpTo)
+			}
+		}
+	}
+
+	order, err := orderSources(sources, byName)
+	if err != nil {
+		return nil, err
+	}
+
+	var versioned, repeatable []Migration
+	for _, name := range order {
+		for _, m := range loaded[name] {
+			m.Name = name + "/" + m.Name
+			m.Namespace = name
+
+			aliases := make([]string, 0, len(m.Aliases))
+			for _, alias := range m.Aliases {
+				aliases = append(aliases, name+"/"+alias)
+			}
+			m.Aliases = aliases
+
+			replaces := make([]string, 0, len(m.Replaces))
+			for _, replaced := range m.Replaces {
+				replaces = append(replaces, name+"/"+replaced)
+			}
+			m.Replaces = replaces
+
+			if m.Repeatable {
+				repeatable = append(repeatable, m)
+			} else {
+				versioned = append(versioned, m)
+			}
+		}
+	}
+
+	return append(versioned, repeatable...), nil
+}
+
+// orderSources returns source names with every source after the sources it
+// requires, keeping the given order where there is no requirement
+func orderSources(sources []Source, byName map[string]Source) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int, len(sources))
+	var order []string
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("migration sources require each other: %s", strings.Join(append(path, name), " -> "))
+		}
+
+		state[name] = visiting
+		for _, req := range byName[name].Requires {
+			err := visit(req.Source, append(path, name))
+			if err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+
+		order = append(order, name)
+		return nil
+	}
+
+	for _, src := range sources {
+		err := visit(src.Name, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+func containsMigration(migrations []Migration, name string) bool {
+	for _, m := range migrations {
+		if m.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// namespaceOf returns the namespace of a migration name, given every known
+// namespace
+func namespaceOf(name string, namespaces map[string]bool) string {
+	i := strings.Index(name, "/")
+	if i < 0 {
+		return ""
+	}
+
+	if namespaces[name[:i]] {
+		return name[:i]
+	}
+
+	return ""
+}
+
+// migrationNamespaces returns every namespace used by migrations
+func migrationNamespaces(migrations []Migration) map[string]bool {
+	namespaces := make(map[string]bool)
+	for _, m := range migrations {
+		if m.Namespace != "" {
+			namespaces[m.Namespace] = true
+		}
+	}
+
+	return namespaces
+}
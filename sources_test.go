@@ -0,0 +1,111 @@
+package trek_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/fortytw2/trek"
+)
+
+func TestGetMigrationsFromSources(t *testing.T) {
+	auth := fstest.MapFS{
+		"01_init.sql":  {Data: []byte("CREATE TABLE users (id integer primary key);")},
+		"03_roles.sql": {Data: []byte("CREATE TABLE roles (id integer primary key);")},
+	}
+
+	billing := fstest.MapFS{
+		"billing/schema/01_init.sql": {Data: []byte("CREATE TABLE invoices (id integer primary key, user_id integer references users (id));")},
+	}
+
+	migrations, err := trek.GetMigrationsFromSources(
+		trek.Source{Name: "billing", FS: billing, Root: "billing/schema", Requires: []trek.Requirement{{Source: "auth", UpTo: "03_roles.sql"}}},
+		trek.Source{Name: "auth", FS: auth},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, m := range migrations {
+		names = append(names, m.Name)
+	}
+
+	want := "auth/01_init.sql auth/03_roles.sql billing/01_init.sql"
+	if strings.Join(names, " ") != want {
+		t.Errorf("got migrations %v, want %s", names, want)
+	}
+
+	if migrations[2].Namespace != "billing" {
+		t.Errorf("got namespace %q, want billing", migrations[2].Namespace)
+	}
+}
+
+func TestGetMigrationsFromSourcesErrors(t *testing.T) {
+	empty := fstest.MapFS{}
+
+	cases := []struct {
+		name    string
+		sources []trek.Source
+	}{
+		{
+			name: "unknown source",
+			sources: []trek.Source{
+				{Name: "billing", FS: empty, Requires: []trek.Requirement{{Source: "auth", UpTo: "01_init.sql"}}},
+			},
+		},
+		{
+			name: "unknown migration",
+			sources: []trek.Source{
+				{Name: "auth", FS: empty},
+				{Name: "billing", FS: empty, Requires: []trek.Requirement{{Source: "auth", UpTo: "01_init.sql"}}},
+			},
+		},
+		{
+			name: "cycle",
+			sources: []trek.Source{
+				{Name: "auth", FS: fstest.MapFS{"01_init.sql": {}}, Requires: []trek.Requirement{{Source: "billing", UpTo: "01_init.sql"}}},
+				{Name: "billing", FS: fstest.MapFS{"01_init.sql": {}}, Requires: []trek.Requirement{{Source: "auth", UpTo: "01_init.sql"}}},
+			},
+		},
+		{
+			name: "duplicate source",
+			sources: []trek.Source{
+				{Name: "auth", FS: empty},
+				{Name: "auth", FS: empty},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := trek.GetMigrationsFromSources(c.sources...)
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestGetPendingMigrationsPerNamespace(t *testing.T) {
+	migrations, err := trek.GetMigrationsFromSources(
+		trek.Source{Name: "users", FS: fstest.MapFS{"01_init.sql": {}, "02_roles.sql": {}}},
+		trek.Source{Name: "billing", FS: fstest.MapFS{"01_init.sql": {}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// billing/01_init.sql sorts before users/02_roles.sql as a string, but is
+	// not out of order as it belongs to another namespace
+	applied := []trek.AppliedMigration{{Name: "users/01_init.sql"}, {Name: "users/02_roles.sql"}}
+
+	pending, err := trek.GetPendingMigrations(migrations, applied, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pending) != 1 || pending[0].Name != "billing/01_init.sql" {
+		t.Errorf("unexpected pending migrations %+v", pending)
+	}
+}
@@ -0,0 +1,100 @@
+package sqlite
+
+import (
+	"context"
+	"time"
+
+	"github.com/fortytw2/trek"
+	"github.com/fortytw2/trek/internal/migrator"
+)
+
+func init() {
+	var _ migrator.History = history{}
+}
+
+// history records migrations in the table name, quoted as table
+type history struct {
+	name  string
+	table string
+}
+
+func (w *SQLiteWrapper) history() history {
+	return history{name: w.migrationsTableName, table: quoteIdentifier(w.migrationsTableName)}
+}
+
+// AppliedMigrations reads the history without changing it, a history that
+// does not exist yet is empty
+func (h history) AppliedMigrations(ctx context.Context, db trek.StdlibDB) ([]trek.AppliedMigration, error) {
+	exists, err := tableExists(ctx, db, h.name)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	query, err := migrator.HistoryQuery(ctx, db, h.table)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, query+";")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []trek.AppliedMigration
+	for rows.Next() {
+		var a trek.AppliedMigration
+		var createdAt string
+		var durationMS int64
+		err = rows.Scan(&a.Name, &a.Checksum, &createdAt, &durationMS, &a.Host, &a.AppVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		a.Duration = time.Duration(durationMS) * time.Millisecond
+
+		a.AppliedAt, err = time.Parse(sqliteTimeFormat, createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		applied = append(applied, a)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// names sort by version, not as strings
+	trek.SortAppliedMigrations(applied)
+
+	return applied, nil
+}
+
+// RecordMigration adds m to the history along with how long it took and who
+// ran it, repeatable migrations replace their previous entry
+func (h history) RecordMigration(ctx context.Context, db trek.StdlibDB, m trek.Migration, duration time.Duration, opts trek.MigrateOptions) error {
+	query := "INSERT INTO " + h.table + " (name, checksum, duration_ms, host, app_version) VALUES ($1, $2, $3, $4, $5)"
+	if m.Repeatable {
+		query += " ON CONFLICT (name) DO UPDATE SET checksum = excluded.checksum, duration_ms = excluded.duration_ms, host = excluded.host, app_version = excluded.app_version, created_at = CURRENT_TIMESTAMP"
+	}
+
+	_, err := db.ExecContext(ctx, query+";", m.Name, m.Checksum(), duration.Milliseconds(), opts.InstanceID, opts.AppVersion)
+	return err
+}
+
+func (h history) UpdateChecksum(ctx context.Context, db trek.StdlibDB, name, checksum string) error {
+	_, err := db.ExecContext(ctx, "UPDATE "+h.table+" SET checksum = $1 WHERE name = $2;", checksum, name)
+	return err
+}
+
+func (h history) RenameMigration(ctx context.Context, db trek.StdlibDB, from, to string) error {
+	_, err := db.ExecContext(ctx, "UPDATE "+h.table+" SET name = $1 WHERE name = $2;", to, from)
+	return err
+}
+
+func (h history) DeleteMigration(ctx context.Context, db trek.StdlibDB, name string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM "+h.table+" WHERE name = $1;", name)
+	return err
+}
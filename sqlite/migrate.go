@@ -3,130 +3,453 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/fortytw2/lounge"
 	"github.com/fortytw2/trek"
+	"github.com/fortytw2/trek/internal/migrator"
+	"github.com/mattn/go-sqlite3"
 )
 
-func (w *SQLiteWrapper) ApplyMigrations(log lounge.Log, allMigrations []trek.Migration) (err error) {
-	err = verifySystemTables(w.db)
+// sqliteTimeFormat is the layout of CURRENT_TIMESTAMP
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// lockPollInterval is how often a waiting migrator retries the migration lock
+const lockPollInterval = 250 * time.Millisecond
+
+func (w *SQLiteWrapper) ApplyMigrations(ctx context.Context, log lounge.Log, migrations []trek.Migration, opts trek.MigrateOptions) error {
+	return w.withMigrationLock(ctx, log, opts, func(m *migrator.Migrator) error {
+		return m.Apply(ctx, migrations, opts)
+	})
+}
+
+func (w *SQLiteWrapper) RollbackMigrations(ctx context.Context, log lounge.Log, migrations []trek.Migration, targetName string) error {
+	return w.withMigrationLock(ctx, log, trek.MigrateOptions{FailIfLocked: true}, func(m *migrator.Migrator) error {
+		return m.Rollback(ctx, migrations, targetName)
+	})
+}
+
+func (w *SQLiteWrapper) RepairMigrations(ctx context.Context, log lounge.Log, migrations []trek.Migration) error {
+	return w.withMigrationLock(ctx, log, trek.MigrateOptions{FailIfLocked: true}, func(m *migrator.Migrator) error {
+		return m.Repair(ctx, migrations)
+	})
+}
+
+// BaselineMigrations records migrations as applied without running them,
+// skipping any already in the history
+func (w *SQLiteWrapper) BaselineMigrations(ctx context.Context, migrations []trek.Migration, opts trek.MigrateOptions) error {
+	return w.withMigrationLock(ctx, w.log, opts, func(m *migrator.Migrator) error {
+		return m.Baseline(ctx, migrations, opts)
+	})
+}
+
+// AppliedMigrations returns the migration history, without taking the
+// migration lock or upgrading the history table
+func (w *SQLiteWrapper) AppliedMigrations(ctx context.Context) ([]trek.AppliedMigration, error) {
+	return w.history().AppliedMigrations(ctx, w.db)
+}
+
+// withMigrationLock runs fn on a connection holding the migration lock with the
+// system tables in place, dry runs leave the tables as they are and read a
+// missing history as empty. If the lock is already held fn is not run, unless
+// opts.LockTimeout is set, in which case the lock is polled for until
+// opts.LockTimeout passes and trek.ErrMigrationLockTimeout is returned.
+//
+// The lock is a lease renewed by a heartbeat while fn runs and by every
+// migration before it commits, a lock whose holder stopped renewing it is
+// taken over. A migrator whose lock was taken over fails with
+// trek.ErrMigrationLockLost. The lock is always released with a fresh
+// context, so a cancelled ctx cannot leave the lock row behind.
+func (w *SQLiteWrapper) withMigrationLock(ctx context.Context, log lounge.Log, opts trek.MigrateOptions, fn func(m *migrator.Migrator) error) (err error) {
+	conn, err := w.db.Conn(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	conn, err := w.db.Conn(context.Background())
-	if err != nil {
-		return err
+	m := &migrator.Migrator{Conn: conn, Log: log, History: w.history(), Dialect: trek.DialectSQLite}
+
+	if opts.Plan != nil {
+		// a dry run changes no tables, and nothing can be migrating before
+		// the lock table exists. A busy database is being written to, so the
+		// lock is taken as usual.
+		ready, err := w.lockTableReady(ctx, conn)
+		if err != nil && !isBusy(err) {
+			return err
+		}
+		if err == nil && !ready {
+			return fn(m)
+		}
+	}
+
+	holder := trek.LockHolder{Owner: randomString(asyncIDLength), Host: opts.InstanceID}
+	if holder.Host == "" {
+		holder.Host, _ = os.Hostname()
 	}
 
-	ok, err := tryToLock(conn)
+	// setting up the lock table needs the database write lock, which a
+	// migrator in another process holds for as long as a migration runs, so a
+	// busy database means the lock is not acquired yet
+	acquire := func() (bool, error) {
+		if opts.Plan == nil {
+			err := w.verifyLockTable(ctx, conn)
+			if isBusy(err) {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+
+		return w.tryToLock(ctx, log, conn, holder)
+	}
+
+	ok, err := acquire()
 	if err != nil {
 		return err
 	}
 
-	if !ok {
-		log.Errorf("unable to migrate database, lock held on table")
+	if !ok && opts.LockTimeout == 0 {
+		if opts.FailIfLocked {
+			return trek.ErrMigrationLocked
+		}
+
+		log.Infof("migration lock held by another process, not running migrations")
 		return nil
 	}
 
+	if !ok {
+		log.Infof("migration lock held by another process, waiting up to %s for it to be released", opts.LockTimeout)
+
+		waitCtx, cancel := context.WithTimeout(ctx, opts.LockTimeout)
+		defer cancel()
+
+		for !ok {
+			select {
+			case <-waitCtx.Done():
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return trek.ErrMigrationLockTimeout
+			case <-time.After(lockPollInterval):
+			}
+
+			ok, err = acquire()
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Infof("acquired migration lock, checking for pending migrations")
+	}
+
+	// the lease is renewed in every migration's transaction, the write lock
+	// that transaction holds keeps anyone else from taking the lock over
+	// until it commits
+	m.CheckLock = func(ctx context.Context, db trek.StdlibDB) error {
+		return w.renewLock(ctx, db, holder.Owner)
+	}
+
+	stopHeartbeat := w.heartbeat(log, holder.Owner)
+
 	defer func() {
-		err2 := unlock(conn)
+		stopHeartbeat()
+
+		err2 := w.unlock(conn, holder.Owner)
 		if err2 != nil {
-			err = fmt.Errorf("%s: %s", err, err2)
+			if err == nil {
+				err = err2
+			} else {
+				err = fmt.Errorf("%w: %s", err, err2)
+			}
 		}
 	}()
 
-	latestName, err := getLatestMigrationName(conn)
+	if opts.Plan == nil {
+		err = w.verifyHistoryTable(ctx, conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return fn(m)
+}
+
+// MigrationLockHolder returns the process holding the migration lock, or nil
+func (w *SQLiteWrapper) MigrationLockHolder(ctx context.Context) (*trek.LockHolder, error) {
+	exists, err := tableExists(ctx, w.db, w.locksTableName)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	// lock tables from before leases are read without upgrading them
+	query := `SELECT owner, host, created_at, expires_at FROM `
+	ready, err := w.lockTableReady(ctx, w.db)
+	if err != nil {
+		return nil, err
+	}
+	if !ready {
+		query = `SELECT '', '', created_at, 0 FROM `
+	}
+
+	row := w.db.QueryRowContext(ctx, query+quoteIdentifier(w.locksTableName)+`;`)
+
+	var holder trek.LockHolder
+	var createdAt string
+	var expiresAt int64
+	err = row.Scan(&holder.Owner, &holder.Host, &createdAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		log.Errorf(err.Error())
+		return nil, err
+	}
+
+	holder.AcquiredAt, err = time.Parse(sqliteTimeFormat, createdAt)
+	if err != nil {
+		return nil, err
+	}
+	holder.ExpiresAt = time.UnixMilli(expiresAt)
+
+	return &holder, nil
+}
+
+// ForceUnlockMigrations deletes the migration lock row. A process still
+// migrating is not stopped, but fails with trek.ErrMigrationLockLost before
+// it can record its current migration.
+func (w *SQLiteWrapper) ForceUnlockMigrations(ctx context.Context) error {
+	exists, err := tableExists(ctx, w.db, w.locksTableName)
+	if err != nil || !exists {
 		return err
 	}
 
-	migrations := trek.GetMigrationsAfter(allMigrations, latestName)
+	_, err = w.db.ExecContext(ctx, `DELETE FROM `+quoteIdentifier(w.locksTableName)+`;`)
+	return err
+}
 
-	for i, m := range migrations {
-		log.Infof("running migration %s", m.Name)
-		err := runMigration(i, m.SQL, conn)
-		if err != nil {
-			return err
-		}
+// heartbeat renews the lease on the lock held by owner until stop is called,
+// keeping it while a migration runs without writing. Renewals fail while a
+// migration holds the database write lock, the migration renews the lease
+// itself before it commits, see renewLock.
+func (w *SQLiteWrapper) heartbeat(log lounge.Log, owner string) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
 
-		err = recordMigration(m.Name, conn)
-		if err != nil {
-			return err
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(w.lockLease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			err := w.renewLock(context.Background(), w.db, owner)
+			if isBusy(err) {
+				continue
+			}
+			if errors.Is(err, trek.ErrMigrationLockLost) {
+				// the migrator stops at its next check
+				log.Errorf("migration lock was released or taken over by another process while migrating")
+				return
+			}
+			if err != nil {
+				log.Infof("could not renew migration lock lease: %s", err)
+			}
 		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// renewLock extends the lease on the lock held by owner, returning
+// trek.ErrMigrationLockLost if owner no longer holds it
+func (w *SQLiteWrapper) renewLock(ctx context.Context, db trek.StdlibDB, owner string) error {
+	res, err := db.ExecContext(ctx, `UPDATE `+quoteIdentifier(w.locksTableName)+` SET expires_at = $1 WHERE owner = $2;`, time.Now().Add(w.lockLease).UnixMilli(), owner)
+	if err != nil {
+		return err
+	}
+
+	renewed, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if renewed == 0 {
+		return trek.ErrMigrationLockLost
 	}
 
 	return nil
 }
 
-func verifySystemTables(db *sql.DB) error {
-	_, err := db.Exec(`
-	CREATE TABLE IF NOT EXISTS migration_locks (
+// verifyLockTable creates or upgrades the migration lock table
+func (w *SQLiteWrapper) verifyLockTable(ctx context.Context, db trek.StdlibDB) error {
+	_, err := db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS `+quoteIdentifier(w.locksTableName)+` (
 		locked INTEGER PRIMARY KEY,
-		created_at INTEGER NOT NULL DEFAULT CURRENT_TIMESTAMP
+		created_at INTEGER NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		owner TEXT NOT NULL DEFAULT '',
+		host TEXT NOT NULL DEFAULT '',
+		expires_at INTEGER NOT NULL DEFAULT 0
 	);`)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS migrations (
+	// upgrade lock tables created before leases, a lock left behind by an
+	// older version has expired
+	lockColumns := []struct{ name, definition string }{
+		{"owner", "TEXT NOT NULL DEFAULT ''"},
+		{"host", "TEXT NOT NULL DEFAULT ''"},
+		{"expires_at", "INTEGER NOT NULL DEFAULT 0"},
+	}
+
+	for _, c := range lockColumns {
+		err = addColumnIfNotExists(ctx, db, w.locksTableName, c.name, c.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lockTableReady reports whether the lock table exists with leases, so the
+// lock can be taken without changing the table
+func (w *SQLiteWrapper) lockTableReady(ctx context.Context, db trek.StdlibDB) (bool, error) {
+	row := db.QueryRowContext(ctx, `SELECT count(*) FROM pragma_table_info($1) WHERE name = 'expires_at';`, w.locksTableName)
+
+	var count int
+	err := row.Scan(&count)
+	return count > 0, err
+}
+
+// verifyHistoryTable creates or upgrades the migration history table
+func (w *SQLiteWrapper) verifyHistoryTable(ctx context.Context, db trek.StdlibDB) error {
+	_, err := db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS `+quoteIdentifier(w.migrationsTableName)+` (
 		id INTEGER PRIMARY KEY,
 		created_at INTEGER NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		name TEXT NOT NULL UNIQUE
+		name TEXT NOT NULL UNIQUE,
+		checksum TEXT NOT NULL DEFAULT '',
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		host TEXT NOT NULL DEFAULT '',
+		app_version TEXT NOT NULL DEFAULT ''
 	);`)
-	return err
-}
+	if err != nil {
+		return err
+	}
 
-func getLatestMigrationName(db *sql.Conn) (string, error) {
-	row := db.QueryRowContext(context.Background(), `SELECT name FROM migrations ORDER BY name DESC LIMIT 1;`)
+	// upgrade history tables created before checksums, durations, hosts and
+	// app versions were recorded
+	columns := []struct{ name, definition string }{
+		{"checksum", "TEXT NOT NULL DEFAULT ''"},
+		{"duration_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"host", "TEXT NOT NULL DEFAULT ''"},
+		{"app_version", "TEXT NOT NULL DEFAULT ''"},
+	}
 
-	var name string
-	err := row.Scan(&name)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", nil
+	for _, c := range columns {
+		err = addColumnIfNotExists(ctx, db, w.migrationsTableName, c.name, c.definition)
+		if err != nil {
+			return err
 		}
-
-		return "", err
 	}
 
-	return name, nil
+	return nil
 }
 
-func runMigration(num int, s string, db *sql.Conn) error {
-	_, err := db.ExecContext(context.Background(), s)
+func tableExists(ctx context.Context, db trek.StdlibDB, table string) (bool, error) {
+	row := db.QueryRowContext(ctx, `SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = $1;`, table)
+
+	var count int
+	err := row.Scan(&count)
+	return count > 0, err
+}
+
+func addColumnIfNotExists(ctx context.Context, db trek.StdlibDB, table, column, definition string) error {
+	row := db.QueryRowContext(ctx, `SELECT count(*) FROM pragma_table_info($1) WHERE name = $2;`, table, column)
+
+	var count int
+	err := row.Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, quoteIdentifier(table), column, definition))
 	return err
 }
 
-func tryToLock(db *sql.Conn) (bool, error) {
-	row := db.QueryRowContext(context.Background(), "SELECT count(*) FROM migration_locks;")
+// tryToLock takes the migration lock by inserting the single lock row, which
+// is atomic across every process sharing the database file. A lock whose lease
+// has expired is taken over. It reports false if another process holds the
+// lock or is writing to the database.
+func (w *SQLiteWrapper) tryToLock(ctx context.Context, log lounge.Log, db *sql.Conn, holder trek.LockHolder) (bool, error) {
+	now := time.Now()
 
-	var lockedInt int
-	err := row.Scan(&lockedInt)
+	// only an expired row is deleted, so two processes taking over the same
+	// lock cannot delete each other's rows
+	res, err := db.ExecContext(ctx, `DELETE FROM `+quoteIdentifier(w.locksTableName)+` WHERE expires_at < $1;`, now.UnixMilli())
 	if err != nil {
+		if isBusy(err) {
+			return false, nil
+		}
 		return false, err
 	}
 
-	locked := lockedInt > 0
-	if !locked {
-		_, err := db.ExecContext(context.Background(), `INSERT INTO migration_locks (locked) VALUES (1);`)
-		if err != nil {
-			return false, err
+	if expired, err := res.RowsAffected(); err == nil && expired > 0 {
+		log.Infof("took over expired migration lock")
+	}
+
+	res, err = db.ExecContext(ctx, `INSERT OR IGNORE INTO `+quoteIdentifier(w.locksTableName)+` (locked, owner, host, expires_at) VALUES (1, $1, $2, $3);`, holder.Owner, holder.Host, now.Add(w.lockLease).UnixMilli())
+	if err != nil {
+		if isBusy(err) {
+			return false, nil
 		}
+		return false, err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
 	}
 
-	return true, nil
+	return inserted == 1, nil
 }
 
-func unlock(db *sql.Conn) error {
-	_, err := db.ExecContext(context.Background(), "DELETE FROM migration_locks;")
-	return err
+// isBusy reports whether err is sqlite refusing a write while another
+// connection holds the database write lock
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
 }
 
-func recordMigration(name string, db *sql.Conn) error {
-	_, err := db.ExecContext(context.Background(), "INSERT INTO migrations (name) VALUES ($1);", name)
+// unlock releases the migration lock if owner still holds it
+func (w *SQLiteWrapper) unlock(db *sql.Conn, owner string) error {
+	_, err := db.ExecContext(context.Background(), "DELETE FROM "+quoteIdentifier(w.locksTableName)+" WHERE owner = $1;", owner)
 	return err
 }
+
+// quoteIdentifier quotes a table or column name for use in a query
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
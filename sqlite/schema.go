@@ -0,0 +1,60 @@
+package sqlite
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fortytw2/trek"
+)
+
+func init() {
+	var _ trek.SchemaDumper = &SQLiteWrapper{}
+}
+
+// DumpSchema returns the CREATE statements of every table, index, view and
+// trigger in the database, from sqlite_master, ordered by type and name.
+// trek's own tables are left out.
+func (w *SQLiteWrapper) DumpSchema(ctx context.Context) (string, error) {
+	rows, err := w.db.QueryContext(ctx, `
+	SELECT sql FROM sqlite_master
+	WHERE sql IS NOT NULL
+	AND name NOT LIKE 'sqlite_%'
+	AND tbl_name NOT IN ($1, $2, $3)
+	ORDER BY
+		CASE type WHEN 'table' THEN 0 WHEN 'index' THEN 1 WHEN 'view' THEN 2 ELSE 3 END,
+		tbl_name,
+		name;`, w.migrationsTableName, w.locksTableName, w.seedsTableName)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var statements []string
+	for rows.Next() {
+		var stmt string
+		err = rows.Scan(&stmt)
+		if err != nil {
+			return "", err
+		}
+
+		statements = append(statements, normalizeStatement(stmt))
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return "", err
+	}
+
+	return trek.JoinSchema(statements), nil
+}
+
+// normalizeStatement strips trailing whitespace from every line of stmt, so
+// dumps do not depend on how migrations were indented
+func normalizeStatement(stmt string) string {
+	lines := strings.Split(strings.TrimSpace(stmt), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+
+	return strings.Join(lines, "\n")
+}
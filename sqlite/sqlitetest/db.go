@@ -0,0 +1,44 @@
+package sqlitetest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fortytw2/lounge"
+	"github.com/fortytw2/trek/internal/golden"
+	"github.com/fortytw2/trek/sqlite"
+)
+
+type DB struct {
+	*sqlite.SQLiteWrapper
+}
+
+// NewDB creates a new, empty, in-memory database
+func NewDB(t *testing.T, log lounge.Log, opts ...sqlite.Option) *DB {
+	db, err := sqlite.NewMemory(log, opts...)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	return &DB{
+		SQLiteWrapper: db,
+	}
+}
+
+func (db *DB) Shutdown() {
+	db.Close()
+}
+
+// AssertSchema fails the test if the schema of the database, usually after
+// trek.Migrate, does not match goldenFile. Run tests with TREK_UPDATE_GOLDEN=1
+// to rewrite goldenFile with the current schema.
+func (db *DB) AssertSchema(t *testing.T, goldenFile string) {
+	t.Helper()
+
+	schema, err := db.DumpSchema(context.Background())
+	if err != nil {
+		t.Fatalf("could not dump schema: %s", err)
+	}
+
+	golden.Assert(t, goldenFile, schema)
+}
@@ -0,0 +1,6 @@
+CREATE TABLE monkeys (
+    id integer primary key not null,
+    name text not null
+);
+
+CREATE INDEX monkey_names ON monkeys (name);
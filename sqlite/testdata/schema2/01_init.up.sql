@@ -0,0 +1,4 @@
+CREATE TABLE monkeys (
+    id integer primary key not null,
+    name text not null
+);
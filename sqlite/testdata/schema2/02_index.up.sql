@@ -0,0 +1 @@
+CREATE INDEX monkey_names ON monkeys (name);
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/fortytw2/lounge"
 	"github.com/fortytw2/trek"
@@ -18,10 +19,22 @@ const asyncIDLength = 12
 // shared sqlite3 settings
 var stdDSN = "&cache=shared&_vacuum=2&_rt=0&_foreign_keys=1&_journal_mode=WAL"
 
+const (
+	defaultMigrationsTable = "migrations"
+	defaultLocksTable      = "migration_locks"
+	defaultSeedsTable      = "trek_seeds"
+	defaultLockLease       = time.Minute
+)
+
 type SQLiteWrapper struct {
 	db  *sql.DB
 	log lounge.Log
 
+	migrationsTableName string
+	locksTableName      string
+	seedsTableName      string
+	lockLease           time.Duration
+
 	execChan chan chan *execPayload
 	shutdown chan chan struct{}
 }
@@ -36,22 +49,55 @@ type execPayload struct {
 	err error
 }
 
-func NewMemory(log lounge.Log) (*SQLiteWrapper, error) {
-	// TODO: generate a random filename for this, not sure if it matters
-	return new(log, "file:test.db?mode=memory"+stdDSN)
+// An Option configures a SQLiteWrapper
+type Option func(*SQLiteWrapper)
+
+// WithMigrationsTable records migration history in table instead of migrations
+func WithMigrationsTable(table string) Option {
+	return func(w *SQLiteWrapper) {
+		w.migrationsTableName = table
+	}
+}
+
+// WithLocksTable serializes migrations using table instead of migration_locks
+func WithLocksTable(table string) Option {
+	return func(w *SQLiteWrapper) {
+		w.locksTableName = table
+	}
+}
+
+// WithSeedsTable records applied seeds in table instead of trek_seeds
+func WithSeedsTable(table string) Option {
+	return func(w *SQLiteWrapper) {
+		w.seedsTableName = table
+	}
+}
+
+// WithLockLease sets how long the migration lock is held without a heartbeat
+// from its holder, after which another process takes it over. The holder
+// renews the lease every third of lease while migrating.
+func WithLockLease(lease time.Duration) Option {
+	return func(w *SQLiteWrapper) {
+		w.lockLease = lease
+	}
 }
 
-func New(log lounge.Log, fileName string) (*SQLiteWrapper, error) {
+func NewMemory(log lounge.Log, opts ...Option) (*SQLiteWrapper, error) {
+	// shared cache memory databases are shared by name, so each instance needs its own
+	return new(log, "file:"+randomString(asyncIDLength)+".db?mode=memory"+stdDSN, opts)
+}
+
+func New(log lounge.Log, fileName string, opts ...Option) (*SQLiteWrapper, error) {
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
 		log.Infof("no '%s' found, initializing a new database", fileName)
 	} else {
 		log.Infof("loading existing '%s'", fileName)
 	}
 
-	return new(log, fmt.Sprintf(`file:%s?mode=rwc%s`, fileName, stdDSN))
+	return new(log, fmt.Sprintf(`file:%s?mode=rwc%s`, fileName, stdDSN), opts)
 }
 
-func new(log lounge.Log, dsn string) (*SQLiteWrapper, error) {
+func new(log lounge.Log, dsn string, opts []Option) (*SQLiteWrapper, error) {
 	sqlDB, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
@@ -77,10 +123,18 @@ func new(log lounge.Log, dsn string) (*SQLiteWrapper, error) {
 	log.Infof("sqlite version: %s", version)
 
 	w := &SQLiteWrapper{
-		db:       sqlDB,
-		log:      log,
-		execChan: make(chan chan *execPayload, 64),
-		shutdown: make(chan chan struct{}),
+		db:                  sqlDB,
+		log:                 log,
+		migrationsTableName: defaultMigrationsTable,
+		locksTableName:      defaultLocksTable,
+		seedsTableName:      defaultSeedsTable,
+		lockLease:           defaultLockLease,
+		execChan:            make(chan chan *execPayload, 64),
+		shutdown:            make(chan chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(w)
 	}
 
 	go w.executor()
@@ -1,19 +1,33 @@
 package sqlite
 
 import (
+	"bytes"
 	"context"
 	"embed"
+	"errors"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/fortytw2/lounge"
 	"github.com/fortytw2/trek"
+	"github.com/fortytw2/trek/internal/golden"
 )
 
 //go:embed testdata/schema1
 var schema embed.FS
 
+//go:embed testdata/schema2
+var reversibleSchema embed.FS
+
+//go:embed testdata/seeds
+var seedData embed.FS
+
 func TestSQLiteMigrations(t *testing.T) {
 	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr), lounge.WithDebugEnabled())
 	db, err := NewMemory(log)
@@ -46,6 +60,1412 @@ func TestSQLiteMigrations(t *testing.T) {
 
 }
 
+func TestSQLiteRollback(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(reversibleSchema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(migrations) != 2 {
+		t.Fatalf("expected 2 paired migrations, got %d", len(migrations))
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Rollback(db, log, migrations, migrations[0].Name)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if countObjects(t, db, "index", "monkey_names") != 0 {
+		t.Error("index was not rolled back")
+	}
+
+	if countObjects(t, db, "table", "monkeys") != 1 {
+		t.Error("rollback target was rolled back")
+	}
+
+	err = trek.Rollback(db, log, migrations, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if countObjects(t, db, "table", "monkeys") != 0 {
+		t.Error("table was not rolled back")
+	}
+
+	// everything can be applied again once rolled back
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if countObjects(t, db, "index", "monkey_names") != 1 {
+		t.Error("index was not re-applied")
+	}
+}
+
+func TestSQLiteChecksumDrift(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	edited := append([]trek.Migration(nil), migrations...)
+	edited[1].SQL = "CREATE INDEX monkey_names ON monkeys (name, id);"
+
+	err = trek.Migrate(db, log, edited)
+
+	var mismatchErr *trek.ChecksumMismatchError
+	if !errors.As(err, &mismatchErr) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+
+	if len(mismatchErr.Mismatches) != 1 || mismatchErr.Mismatches[0].Name != edited[1].Name {
+		t.Fatalf("unexpected mismatches %+v", mismatchErr.Mismatches)
+	}
+
+	err = trek.Repair(db, log, edited)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, edited)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestSQLiteOutOfOrderMigrations(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a migration merged from a branch sorts between the two applied ones
+	branchMigration := trek.Migration{
+		Name: "testdata/schema1/01_init_branch.sql",
+		SQL:  "CREATE TABLE bananas (id integer primary key not null);",
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	merged := []trek.Migration{migrations[0], branchMigration, migrations[1]}
+
+	err = trek.Migrate(db, log, merged)
+
+	var outOfOrderErr *trek.OutOfOrderError
+	if !errors.As(err, &outOfOrderErr) {
+		t.Fatalf("expected an out of order error, got %v", err)
+	}
+
+	if len(outOfOrderErr.Missing) != 1 || outOfOrderErr.Missing[0] != branchMigration.Name {
+		t.Fatalf("unexpected missing migrations %v", outOfOrderErr.Missing)
+	}
+
+	err = trek.Migrate(db, log, merged, trek.AllowOutOfOrder())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if countObjects(t, db, "table", "bananas") != 1 {
+		t.Error("out of order migration was not applied")
+	}
+}
+
+func TestSQLiteMigrationsAreAtomic(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	broken := []trek.Migration{{
+		Name: "01_broken.sql",
+		SQL:  "CREATE TABLE bananas (id integer primary key not null); INSERT INTO missing_table VALUES (1);",
+	}}
+
+	err = trek.Migrate(db, log, broken)
+	if err == nil {
+		t.Fatal("expected broken migration to fail")
+	}
+
+	if countObjects(t, db, "table", "bananas") != 0 {
+		t.Error("partially applied migration was not rolled back")
+	}
+
+	broken[0].SQL = "-- trek:no-transaction\n" + broken[0].SQL
+
+	err = trek.Migrate(db, log, broken)
+	if err == nil {
+		t.Fatal("expected broken migration to fail")
+	}
+
+	if countObjects(t, db, "table", "bananas") != 1 {
+		t.Error("no-transaction migration was rolled back")
+	}
+}
+
+func TestSQLiteMigrationStatements(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations := []trek.Migration{{
+		Name: "01_audit.sql",
+		SQL: `CREATE TABLE bananas (id integer primary key not null);
+CREATE TABLE audit (note text);
+
+CREATE TRIGGER bananas_audit AFTER INSERT ON bananas BEGIN
+	INSERT INTO audit VALUES ('banana; added');
+END;`,
+	}, {
+		Name: "02_broken.sql",
+		SQL: `INSERT INTO bananas VALUES (1);
+
+-- the table is misspelled
+INSERT INTO banans VALUES (2);`,
+	}}
+
+	err = trek.Migrate(db, log, migrations)
+
+	var statementErr *trek.StatementError
+	if !errors.As(err, &statementErr) {
+		t.Fatalf("expected a statement error, got %v", err)
+	}
+
+	if statementErr.Line != 4 || statementErr.SQL != "INSERT INTO banans VALUES (2)" {
+		t.Errorf("unexpected failing statement %d %q", statementErr.Line, statementErr.SQL)
+	}
+
+	if countObjects(t, db, "trigger", "bananas_audit") != 1 {
+		t.Error("trigger was not created")
+	}
+}
+
+func TestSQLiteGoMigrations(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	sqlMigrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	migrations, err := trek.AddGoMigrations(sqlMigrations, trek.Migration{
+		Name: "testdata/schema1/01_seed_monkeys.go",
+		Func: func(db trek.DB) error {
+			return db.Exec(context.TODO(), "INSERT INTO monkeys (id, name) VALUES (1, 'bubbles');")
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if migrations[1].Name != "testdata/schema1/01_seed_monkeys.go" {
+		t.Fatalf("go migration sorted out of sequence: %s", migrations[1].Name)
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	row := db.QueryRow(context.TODO(), "SELECT count(*) FROM monkeys;")
+
+	var count int
+	err = row.Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("expected the go migration to insert 1 monkey, got %d", count)
+	}
+}
+
+func TestSQLiteStatus(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	report, err := trek.Status(context.TODO(), db, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(report.Applied) != 0 || len(report.Pending) != 2 {
+		t.Fatalf("unexpected status of a new database %+v", report)
+	}
+
+	err = trek.Migrate(db, log, migrations[:1])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	report, err = trek.Status(context.TODO(), db, migrations[1:])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(report.Applied) != 1 || report.Applied[0].AppliedAt.IsZero() {
+		t.Errorf("unexpected applied migrations %+v", report.Applied)
+	}
+
+	if len(report.Pending) != 1 || report.Pending[0].Name != migrations[1].Name {
+		t.Errorf("unexpected pending migrations %+v", report.Pending)
+	}
+
+	if len(report.Unknown) != 1 || report.Unknown[0].Name != migrations[0].Name {
+		t.Errorf("unexpected unknown migrations %+v", report.Unknown)
+	}
+}
+
+func TestSQLiteStatusLeavesHistoryUnchanged(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a history table from before migration metadata was recorded
+	_, err = db.db.Exec(`CREATE TABLE migrations (
+		id INTEGER PRIMARY KEY,
+		created_at INTEGER NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		name TEXT NOT NULL UNIQUE
+	);
+	INSERT INTO migrations (name) VALUES ('testdata/schema1/01_init.sql');`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	report, err := trek.Status(context.TODO(), db, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(report.Applied) != 1 || report.Applied[0].Checksum != "" || len(report.Pending) != 1 {
+		t.Errorf("unexpected status %+v", report)
+	}
+
+	if countColumns(t, db, "migrations") != 3 || countObjects(t, db, "table", "migration_locks") != 0 {
+		t.Error("status changed the history tables")
+	}
+}
+
+func TestSQLitePlan(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations[:1])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	planned, err := trek.Plan(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(planned) != 1 || planned[0].Name != migrations[1].Name {
+		t.Fatalf("unexpected plan %+v", planned)
+	}
+
+	var buf bytes.Buffer
+	err = trek.Migrate(db, log, migrations, trek.DryRun(&buf))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !strings.Contains(buf.String(), migrations[1].SQL) {
+		t.Errorf("dry run did not write pending SQL, got %q", buf.String())
+	}
+
+	if countObjects(t, db, "index", "monkey_names") != 0 {
+		t.Error("dry run applied a migration")
+	}
+}
+
+func TestSQLitePlanChangesNothing(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	planned, err := trek.Plan(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(planned) != 2 {
+		t.Fatalf("unexpected plan %+v", planned)
+	}
+
+	if countObjects(t, db, "table", "migrations") != 0 || countObjects(t, db, "table", "migration_locks") != 0 {
+		t.Error("plan created the system tables")
+	}
+}
+
+func TestSQLiteMigrationTimeout(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	slow := []trek.Migration{{
+		Name: "01_slow.sql",
+		SQL:  "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c) SELECT count(*) FROM c;",
+	}}
+
+	err = trek.Migrate(db, log, slow, trek.WithMigrationTimeout(50*time.Millisecond))
+
+	var timeoutErr *trek.MigrationTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected a migration timeout, got %v", err)
+	}
+
+	if timeoutErr.Name != "01_slow.sql" {
+		t.Errorf("timeout named the wrong migration: %s", timeoutErr.Name)
+	}
+
+	report, err := trek.Status(context.TODO(), db, slow)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(report.Pending) != 1 {
+		t.Error("timed out migration was recorded as applied")
+	}
+}
+
+func TestSQLiteMigrateAfterTimeout(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations := []trek.Migration{{
+		Name: "01_slow.sql",
+		SQL:  "CREATE TABLE monkeys (id integer primary key not null);\nWITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c) SELECT count(*) FROM c;",
+	}}
+
+	err = trek.Migrate(db, log, migrations, trek.WithMigrationTimeout(50*time.Millisecond))
+
+	var timeoutErr *trek.MigrationTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected a migration timeout, got %v", err)
+	}
+
+	// the timed out migrator released the lock, so the next run migrates
+	migrations[0].SQL = "CREATE TABLE monkeys (id integer primary key not null);"
+	err = trek.Migrate(db, log, migrations, trek.FailIfLocked())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	report, err := trek.Status(context.TODO(), db, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(report.Pending) != 0 {
+		t.Errorf("migration did not run after a timeout: %+v", report.Pending)
+	}
+}
+
+func TestSQLiteCustomMigrationTables(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log, WithMigrationsTable("billing_migrations"), WithLocksTable("billing_migration_locks"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if countObjects(t, db, "table", "billing_migrations") != 1 || countObjects(t, db, "table", "billing_migration_locks") != 1 {
+		t.Error("custom migration tables were not created")
+	}
+
+	if countObjects(t, db, "table", "migrations") != 0 || countObjects(t, db, "table", "migration_locks") != 0 {
+		t.Error("default migration tables were created")
+	}
+}
+
+func TestSQLiteMigrationLock(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	file := filepath.Join(t.TempDir(), "locked.db")
+
+	// two wrappers on one file stand in for two processes
+	holder, err := New(log, file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer holder.Close()
+
+	db, err := New(log, file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conn, err := holder.db.Conn(context.TODO())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	err = holder.verifyLockTable(context.TODO(), holder.db)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ok, err := holder.tryToLock(context.TODO(), log, conn, trek.LockHolder{Owner: "holder", Host: "test"})
+	if err != nil || !ok {
+		t.Fatalf("could not take the lock: %v", err)
+	}
+
+	err = trek.Migrate(db, log, migrations, trek.FailIfLocked())
+	if !errors.Is(err, trek.ErrMigrationLocked) {
+		t.Errorf("expected ErrMigrationLocked, got %v", err)
+	}
+
+	err = trek.Migrate(db, log, migrations, trek.WaitForLock(time.Millisecond))
+	if !errors.Is(err, trek.ErrMigrationLockTimeout) {
+		t.Errorf("expected ErrMigrationLockTimeout, got %v", err)
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if countObjects(t, db, "table", "monkeys") != 0 {
+		t.Fatal("migrations ran while the lock was held")
+	}
+
+	err = holder.unlock(conn, "holder")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations, trek.FailIfLocked())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if countObjects(t, db, "table", "monkeys") != 1 {
+		t.Error("migrations did not run once the lock was released")
+	}
+}
+
+func TestSQLiteMigrationLockWhileMigrating(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	file := filepath.Join(t.TempDir(), "migrating.db")
+
+	// two wrappers on one file stand in for two processes
+	leader, err := New(log, file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer leader.Close()
+
+	follower, err := New(log, file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer follower.Close()
+
+	// the leader holds the database write lock for as long as the migration runs
+	started := make(chan struct{})
+	release := make(chan struct{})
+	migrations, err := trek.AddGoMigrations(nil, trek.Migration{
+		Name: "01_bananas.go",
+		Func: func(tx trek.DB) error {
+			err := tx.Exec(context.TODO(), `CREATE TABLE bananas (id integer primary key not null);`)
+			if err != nil {
+				return err
+			}
+
+			close(started)
+			<-release
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	leaderErr := make(chan error, 1)
+	go func() {
+		leaderErr <- trek.Migrate(leader, log, migrations)
+	}()
+	<-started
+
+	err = trek.Migrate(follower, log, migrations, trek.FailIfLocked())
+	if !errors.Is(err, trek.ErrMigrationLocked) {
+		t.Errorf("expected ErrMigrationLocked, got %v", err)
+	}
+
+	err = trek.Migrate(follower, log, migrations)
+	if err != nil {
+		t.Errorf("expected the follower to skip migrating, got %v", err)
+	}
+
+	followerErr := make(chan error, 1)
+	go func() {
+		followerErr <- trek.Migrate(follower, log, migrations, trek.WaitForLock(20*time.Second))
+	}()
+
+	// let the follower poll the held lock before the leader finishes
+	time.Sleep(2 * lockPollInterval)
+	close(release)
+
+	if err := <-leaderErr; err != nil {
+		t.Fatalf("leader failed: %s", err)
+	}
+
+	if err := <-followerErr; err != nil {
+		t.Fatalf("follower did not wait for the leader: %s", err)
+	}
+
+	if countObjects(t, follower, "table", "bananas") != 1 {
+		t.Error("leader did not apply its migration")
+	}
+
+	applied, err := follower.AppliedMigrations(context.TODO())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(applied) != 1 {
+		t.Errorf("expected the migration to be applied once, got %+v", applied)
+	}
+}
+
+func TestSQLiteStaleMigrationLock(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log, WithLockLease(time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	holder, err := trek.CurrentLockHolder(context.TODO(), db)
+	if err != nil || holder != nil {
+		t.Fatalf("expected no lock holder, got %v %v", holder, err)
+	}
+
+	// a process that crashed while migrating
+	err = trek.Migrate(db, log, migrations[:1])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = db.db.Exec(`INSERT INTO migration_locks (locked, owner, host, expires_at) VALUES (1, 'crashed', 'old-host', $1);`, time.Now().Add(-time.Second).UnixMilli())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	holder, err = trek.CurrentLockHolder(context.TODO(), db)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if holder == nil || holder.Owner != "crashed" || holder.Host != "old-host" {
+		t.Fatalf("unexpected lock holder %v", holder)
+	}
+
+	err = trek.Migrate(db, log, migrations, trek.FailIfLocked())
+	if err != nil {
+		t.Fatalf("expired lock was not taken over: %s", err)
+	}
+
+	holder, err = trek.CurrentLockHolder(context.TODO(), db)
+	if err != nil || holder != nil {
+		t.Fatalf("lock was not released, got %v %v", holder, err)
+	}
+
+	// a live lock is only released by force
+	_, err = db.db.Exec(`INSERT INTO migration_locks (locked, owner, host, expires_at) VALUES (1, 'hung', 'old-host', $1);`, time.Now().Add(time.Hour).UnixMilli())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations, trek.FailIfLocked())
+	if !errors.Is(err, trek.ErrMigrationLocked) {
+		t.Fatalf("expected ErrMigrationLocked, got %v", err)
+	}
+
+	err = trek.ForceUnlock(context.TODO(), db, log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations, trek.FailIfLocked())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestSQLiteMigrationLockHeartbeat(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log, WithLockLease(90*time.Millisecond))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	slow, err := trek.AddGoMigrations(nil, trek.Migration{
+		Name: "01_slow.go",
+		Func: func(tx trek.DB) error {
+			time.Sleep(300 * time.Millisecond)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- trek.Migrate(db, log, slow)
+	}()
+
+	// the lease is renewed well past its initial expiry while migrating
+	time.Sleep(200 * time.Millisecond)
+
+	err = trek.Migrate(db, log, slow, trek.FailIfLocked())
+	if !errors.Is(err, trek.ErrMigrationLocked) {
+		t.Errorf("expected ErrMigrationLocked while the holder is alive, got %v", err)
+	}
+
+	err = <-errs
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestSQLiteMigrationLockLost(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	migrations, err := trek.AddGoMigrations(nil, trek.Migration{
+		Name: "01_bananas.go",
+		Func: func(tx trek.DB) error {
+			close(started)
+			<-release
+			return tx.Exec(context.TODO(), `CREATE TABLE bananas (id integer primary key not null);`)
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- trek.Migrate(db, log, migrations)
+	}()
+	<-started
+
+	err = trek.ForceUnlock(context.TODO(), db, log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	close(release)
+
+	err = <-errs
+	if !errors.Is(err, trek.ErrMigrationLockLost) {
+		t.Fatalf("expected ErrMigrationLockLost, got %v", err)
+	}
+
+	applied, err := db.AppliedMigrations(context.TODO())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(applied) != 0 || countObjects(t, db, "table", "bananas") != 0 {
+		t.Error("migration was committed after the lock was lost")
+	}
+}
+
+func TestSQLiteMigrationLongerThanLease(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	file := filepath.Join(t.TempDir(), "leased.db")
+
+	leader, err := New(log, file, WithLockLease(150*time.Millisecond))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer leader.Close()
+
+	follower, err := New(log, file, WithLockLease(150*time.Millisecond))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer follower.Close()
+
+	// the write lock held by the first migration keeps the heartbeat from
+	// renewing the lease until long after it expires
+	started := make(chan struct{})
+	migrations, err := trek.AddGoMigrations([]trek.Migration{
+		{Name: "02_index.sql", SQL: "CREATE INDEX banana_ids ON bananas (id);"},
+	}, trek.Migration{
+		Name: "01_bananas.go",
+		Func: func(tx trek.DB) error {
+			err := tx.Exec(context.TODO(), `CREATE TABLE bananas (id integer primary key not null);`)
+			if err != nil {
+				return err
+			}
+
+			close(started)
+			time.Sleep(600 * time.Millisecond)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	leaderErr := make(chan error, 1)
+	go func() {
+		leaderErr <- trek.Migrate(leader, log, migrations)
+	}()
+	<-started
+
+	err = trek.Migrate(follower, log, migrations, trek.WaitForLock(20*time.Second))
+	if err != nil {
+		t.Fatalf("follower failed: %s", err)
+	}
+
+	if err := <-leaderErr; err != nil {
+		t.Fatalf("leader failed: %s", err)
+	}
+
+	applied, err := follower.AppliedMigrations(context.TODO())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(applied) != 2 {
+		t.Errorf("expected each migration to be applied once, got %+v", applied)
+	}
+}
+
+func TestSQLiteMigrationMetadata(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a history table from before migration metadata was recorded
+	err = db.Exec(`CREATE TABLE migrations (
+		id INTEGER PRIMARY KEY,
+		created_at INTEGER NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		name TEXT NOT NULL UNIQUE
+	);`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations[:1])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations, trek.WithAppVersion("v1.2.3"), trek.WithInstanceID("worker-1"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	applied, err := db.AppliedMigrations(context.TODO())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	hostname, _ := os.Hostname()
+	if applied[0].Host != hostname || applied[0].AppVersion != "" {
+		t.Errorf("unexpected metadata for the first migration %+v", applied[0])
+	}
+
+	if applied[1].Host != "worker-1" || applied[1].AppVersion != "v1.2.3" || applied[1].Duration < 0 {
+		t.Errorf("unexpected metadata for the second migration %+v", applied[1])
+	}
+}
+
+func TestSQLiteBaseline(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	// a schema created by hand, before adopting trek
+	err = db.Exec(`CREATE TABLE monkeys (id integer primary key not null, name text not null);`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Baseline(db, migrations, migrations[0].Name)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if countObjects(t, db, "index", "monkey_names") != 1 {
+		t.Error("migration after the baseline was not applied")
+	}
+}
+
+func TestSQLiteSquash(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	scratch, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer scratch.Close()
+
+	baseline, err := trek.Squash(context.TODO(), scratch, log, migrations, "testdata/schema1/02_index.sql")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if baseline.Name != "testdata/schema1/02_baseline.sql" || !reflect.DeepEqual(baseline.Replaces, []string{"testdata/schema1/01_init.sql", "testdata/schema1/02_index.sql"}) {
+		t.Fatalf("unexpected baseline %s replacing %v", baseline.Name, baseline.Replaces)
+	}
+
+	squashed, err := trek.GetMigrations(fstest.MapFS{
+		"testdata/schema1/02_baseline.sql": {Data: []byte(baseline.SQL)},
+		"testdata/schema1/03_bananas.sql":  {Data: []byte("CREATE TABLE bananas (id integer primary key not null);")},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a database migrated before the squash records the baseline
+	existing, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer existing.Close()
+
+	err = trek.Migrate(existing, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(existing, log, squashed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	applied, err := existing.AppliedMigrations(context.TODO())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(applied) != 4 || applied[1].Name != "testdata/schema1/02_baseline.sql" || applied[3].Name != "testdata/schema1/03_bananas.sql" {
+		t.Errorf("baseline was not recorded %+v", applied)
+	}
+
+	// a new database runs only the baseline
+	fresh, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer fresh.Close()
+
+	err = trek.Migrate(fresh, log, squashed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	applied, err = fresh.AppliedMigrations(context.TODO())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(applied) != 2 || countObjects(t, fresh, "index", "monkey_names") != 1 {
+		t.Errorf("baseline was not applied %+v", applied)
+	}
+
+	_, err = trek.Squash(context.TODO(), fresh, log, squashed, "testdata/schema1/03_bananas.sql")
+	if err == nil {
+		t.Error("expected squashing into a migrated database to fail")
+	}
+}
+
+func TestSQLiteRenamedMigrations(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrationsIn(schema, "testdata/schema1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// histories recorded before names were relative to the migration root
+	var pathNamed []trek.Migration
+	for _, m := range migrations {
+		m.Name, m.Aliases = m.Aliases[0], nil
+		pathNamed = append(pathNamed, m)
+	}
+
+	err = trek.Migrate(db, log, pathNamed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// re-running the migrations would fail to create existing tables
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	applied, err := db.AppliedMigrations(context.TODO())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(applied) != 2 || applied[0].Name != "01_init.sql" || applied[1].Name != "02_index.sql" {
+		t.Errorf("history was not renamed %+v", applied)
+	}
+}
+
+func TestSQLiteSeeds(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	seeds, err := trek.GetSeeds(seedData)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.ApplySeeds(db, log, seeds, "prod")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if n := countMonkeys(t, db); n != 2 {
+		t.Fatalf("expected 2 seeded monkeys in prod, got %d", n)
+	}
+
+	// seeds that already ran are skipped, dev only seeds run in dev
+	err = trek.ApplySeeds(db, log, seeds, "dev")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if n := countMonkeys(t, db); n != 3 {
+		t.Fatalf("expected 3 seeded monkeys in dev, got %d", n)
+	}
+
+	// an edited seed runs again
+	seeds[0].SQL = "INSERT INTO monkeys (id, name) VALUES (3, 'abu') ON CONFLICT (id) DO NOTHING;"
+	err = trek.ApplySeeds(db, log, seeds, "dev")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if n := countMonkeys(t, db); n != 4 {
+		t.Fatalf("expected the edited seed to run again, got %d monkeys", n)
+	}
+}
+
+func TestSQLiteSeedsBesideUserSeedsTable(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(fstest.MapFS{
+		"01_init.sql": {Data: []byte("CREATE TABLE monkeys (id integer primary key not null, name text not null);\nCREATE TABLE seeds (id integer primary key not null, variety text not null);")},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	seeds, err := trek.GetSeedsIn(seedData, "testdata/seeds")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.ApplySeeds(db, log, seeds, "prod")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	dump, err := db.DumpSchema(context.TODO())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !strings.Contains(dump, "CREATE TABLE seeds") {
+		t.Errorf("schema dump left out the user's seeds table\n%s", dump)
+	}
+}
+
+func TestSQLiteSeedsDryRun(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	seeds, err := trek.GetSeedsIn(seedData, "testdata/seeds")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var plan bytes.Buffer
+	err = trek.ApplySeeds(db, log, seeds, "dev", trek.DryRun(&plan))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !strings.Contains(plan.String(), "-- migration 2/2: 02_demo_monkeys.sql") {
+		t.Errorf("unexpected seed plan\n%s", plan.String())
+	}
+
+	if n := countMonkeys(t, db); n != 0 {
+		t.Errorf("dry run applied seeds, got %d monkeys", n)
+	}
+
+	if countObjects(t, db, "table", db.seedsTableName) != 0 {
+		t.Error("dry run created the seeds table")
+	}
+}
+
+func countMonkeys(t *testing.T, db *SQLiteWrapper) int {
+	t.Helper()
+
+	row := db.QueryRow(context.TODO(), "SELECT count(*) FROM monkeys;")
+
+	var count int
+	err := row.Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestSQLiteDumpSchema(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations, err := trek.GetMigrations(schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	dump, err := db.DumpSchema(context.TODO())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	golden.Assert(t, "testdata/schema1.golden.sql", dump)
+}
+
+func TestSQLiteTemplatedMigrations(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	migrations := []trek.Migration{{
+		Name: "01_init.sql",
+		SQL:  "CREATE TABLE {{ .Prefix }}_monkeys (id integer primary key not null);",
+	}}
+
+	err = trek.Migrate(db, log, migrations, trek.WithTemplateData(map[string]string{}))
+	if err == nil || !strings.Contains(err.Error(), "01_init.sql") {
+		t.Fatalf("expected a template error naming the migration, got %v", err)
+	}
+
+	data := map[string]string{"Prefix": "staging"}
+
+	err = trek.Migrate(db, log, migrations, trek.WithTemplateData(data))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if countObjects(t, db, "table", "staging_monkeys") != 1 {
+		t.Error("templated migration was not rendered")
+	}
+
+	rendered, err := trek.RenderMigrations(migrations, data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	report, err := trek.Status(context.TODO(), db, rendered)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(report.Modified) != 0 {
+		t.Error("checksum was not taken from the rendered migration")
+	}
+}
+
+func TestSQLiteRepeatableMigrations(t *testing.T) {
+	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr))
+	db, err := NewMemory(log)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+
+	files := fstest.MapFS{
+		"schema/R__named_monkeys.sql": {Data: []byte("DROP VIEW IF EXISTS named_monkeys;\nCREATE VIEW named_monkeys AS SELECT name FROM monkeys;")},
+		"schema/01_init.sql":          {Data: []byte("CREATE TABLE monkeys (id integer primary key not null, name text not null);")},
+	}
+
+	migrations, err := trek.GetMigrations(files)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !migrations[1].Repeatable {
+		t.Fatalf("repeatable migration did not sort after versioned migrations: %+v", migrations)
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	planned, err := trek.Plan(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if len(planned) != 0 {
+		t.Fatalf("unchanged repeatable migration is pending: %+v", planned)
+	}
+
+	files["schema/R__named_monkeys.sql"] = &fstest.MapFile{Data: []byte("DROP VIEW IF EXISTS named_monkeys;\nCREATE VIEW named_monkeys AS SELECT id, name FROM monkeys;")}
+
+	migrations, err = trek.GetMigrations(files)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = trek.Migrate(db, log, migrations)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	row := db.QueryRow(context.TODO(), "SELECT count(*) FROM pragma_table_info('named_monkeys');")
+
+	var columns int
+	err = row.Scan(&columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if columns != 2 {
+		t.Errorf("changed repeatable migration was not re-run, view has %d columns", columns)
+	}
+}
+
+func countObjects(t *testing.T, db *SQLiteWrapper, objectType, name string) int {
+	t.Helper()
+
+	row := db.QueryRow(context.TODO(), "SELECT count(*) FROM sqlite_master WHERE type = $1 AND name = $2;", objectType, name)
+
+	var count int
+	err := row.Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func countColumns(t *testing.T, db *SQLiteWrapper, table string) int {
+	t.Helper()
+
+	row := db.QueryRow(context.TODO(), "SELECT count(*) FROM pragma_table_info($1);", table)
+
+	var count int
+	err := row.Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
 func TestSQLiteSerializedExecutor(t *testing.T) {
 	log := lounge.NewDefaultLog(lounge.WithOutput(os.Stderr), lounge.WithDebugEnabled())
 
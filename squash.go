@@ -0,0 +1,161 @@
+package trek
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fortytw2/lounge"
+)
+
+// ReplacesDirective names a migration a squashed baseline replaces, one per
+// line, see Squash
+//
+//	-- trek:replaces 01_init.sql
+const ReplacesDirective = "replaces"
+
+// Squash migrates db, which must have no migration history, up to and
+// including upToName, then returns a baseline migration built from a dump of
+// its schema that replaces those migrations. Save the baseline's SQL in a
+// file named after it in place of the replaced files: new databases run only
+// the baseline, databases that applied the replaced migrations record the
+// baseline as applied without running it. Data inserted by the replaced
+// migrations is not part of the dump, keep it in seeds, see GetSeeds. The
+// baseline holds what the backend's DumpSchema can recreate, review it before
+// replacing the migrations.
+func Squash(ctx context.Context, db interface {
+	MigratableDB
+	SchemaDumper
+}, log lounge.Log, allMigrations []Migration, upToName string, opts ...MigrateOption) (Migration, error) {
+	name, err := baselineName(upToName)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	squashed, err := GetMigrationsUpTo(allMigrations, upToName)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	applied, err := db.AppliedMigrations(ctx)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	if len(applied) > 0 {
+		return Migration{}, fmt.Errorf("cannot squash migrations into a database with %d applied migrations", len(applied))
+	}
+
+	err = MigrateContext(ctx, db, log, squashed, opts...)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	schema, err := db.DumpSchema(ctx)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	var sql strings.Builder
+	for _, m := range squashed {
+		if m.IsGo() {
+			log.Infof("migration %s is Go code, any data it changed is not part of the baseline", m.Name)
+		}
+
+		// squashing a baseline carries over what it replaced, names in the
+		// file are relative to the Source it is loaded from
+		for _, name := range append(append([]string(nil), m.Replaces...), m.Name) {
+			if m.Namespace != "" {
+				name = strings.TrimPrefix(name, m.Namespace+"/")
+			}
+			fmt.Fprintf(&sql, "%s%s %s\n", directivePrefix, ReplacesDirective, name)
+		}
+	}
+
+	fmt.Fprintf(&sql, "\n%s", schema)
+
+	return Migration{
+		Name:      name,
+		SQL:       sql.String(),
+		Replaces:  replacedNames(squashed),
+		Namespace: squashed[len(squashed)-1].Namespace,
+	}, nil
+}
+
+// baselineName names the baseline replacing every migration up to name, with
+// the version of name, e.g. 0120_baseline.sql for 0120_add_users.sql
+func baselineName(name string) (string, error) {
+	_, err := ParseVersion(name)
+	if err != nil {
+		return "", err
+	}
+
+	base := path.Base(name)
+	digits := strings.IndexFunc(base, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	if digits < 0 {
+		digits = len(base)
+	}
+
+	return path.Join(path.Dir(name), base[:digits]+"_baseline.sql"), nil
+}
+
+func replacedNames(migrations []Migration) []string {
+	var names []string
+	for _, m := range migrations {
+		names = append(names, m.Replaces...)
+		names = append(names, m.Name)
+	}
+
+	return names
+}
+
+// GetReplacingMigrations returns every squashed baseline that has not been
+// applied, but every migration it replaces has. They must be recorded as
+// applied without running them. A database that applied only some of the
+// migrations a baseline replaces cannot be migrated past the baseline.
+func GetReplacingMigrations(migrations []Migration, applied []AppliedMigration) ([]Migration, error) {
+	appliedNames := make(map[string]bool, len(applied))
+	for _, a := range applied {
+		appliedNames[a.Name] = true
+	}
+
+	var out []Migration
+	for _, m := range migrations {
+		if len(m.Replaces) == 0 || appliedNames[m.Name] {
+			continue
+		}
+
+		var missing []string
+		for _, name := range m.Replaces {
+			if !appliedNames[name] {
+				missing = append(missing, name)
+			}
+		}
+
+		switch {
+		case len(missing) == 0:
+			out = append(out, m)
+		case len(missing) < len(m.Replaces):
+			return nil, fmt.Errorf("baseline %s replaces migrations that have not been applied: %s, apply them from the original files first", m.Name, strings.Join(missing, ", "))
+		}
+	}
+
+	return out, nil
+}
+
+// ApplyReplacing returns applied with every migration in replacing recorded,
+// see GetReplacingMigrations
+func ApplyReplacing(applied []AppliedMigration, replacing []Migration) []AppliedMigration {
+	out := append([]AppliedMigration(nil), applied...)
+	for _, m := range replacing {
+		out = append(out, AppliedMigration{Name: m.Name, Checksum: m.Checksum(), AppliedAt: time.Now()})
+	}
+
+	SortAppliedMigrations(out)
+
+	return out
+}
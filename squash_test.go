@@ -0,0 +1,79 @@
+package trek_test
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/fortytw2/trek"
+)
+
+func TestGetMigrationsReplaces(t *testing.T) {
+	fsys := fstest.MapFS{
+		"schema/02_baseline.sql": {Data: []byte("-- trek:replaces 01_init.sql\n-- trek:replaces 02_users.sql\n\nCREATE TABLE users (id integer);")},
+		"schema/03_posts.sql":    {Data: []byte("CREATE TABLE posts (id integer);")},
+	}
+
+	migrations, err := trek.GetMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(migrations[0].Replaces, []string{"01_init.sql", "02_users.sql"}) || migrations[1].Replaces != nil {
+		t.Errorf("unexpected replaces %v and %v", migrations[0].Replaces, migrations[1].Replaces)
+	}
+}
+
+func TestGetReplacingMigrations(t *testing.T) {
+	migrations := []trek.Migration{
+		{Name: "02_baseline.sql", Replaces: []string{"01_init.sql", "02_users.sql"}},
+		{Name: "03_posts.sql"},
+	}
+
+	cases := []struct {
+		name    string
+		applied []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "new database"},
+		{name: "squashed migrations applied", applied: []string{"01_init.sql", "02_users.sql"}, want: []string{"02_baseline.sql"}},
+		{name: "baseline applied", applied: []string{"02_baseline.sql"}},
+		{name: "baseline recorded", applied: []string{"01_init.sql", "02_baseline.sql", "02_users.sql"}},
+		{name: "squashed migrations partly applied", applied: []string{"01_init.sql"}, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var applied []trek.AppliedMigration
+			for _, name := range c.applied {
+				applied = append(applied, trek.AppliedMigration{Name: name})
+			}
+
+			replacing, err := trek.GetReplacingMigrations(migrations, applied)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %v", err, c.wantErr)
+			}
+
+			var names []string
+			for _, m := range replacing {
+				names = append(names, m.Name)
+			}
+
+			if !reflect.DeepEqual(names, c.want) {
+				t.Errorf("got %v, want %v", names, c.want)
+			}
+		})
+	}
+
+	// squashed migrations are neither pending nor unknown
+	applied := []trek.AppliedMigration{{Name: "01_init.sql"}, {Name: "02_users.sql"}}
+	if err := trek.VerifyVersions(migrations, applied); err != nil {
+		t.Error(err)
+	}
+
+	report := trek.GetStatus(migrations, applied)
+	if len(report.Unknown) != 0 || len(report.Pending) != 1 || report.Pending[0].Name != "03_posts.sql" {
+		t.Errorf("unexpected status %+v", report)
+	}
+}
@@ -0,0 +1,83 @@
+package trek
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/fortytw2/trek/internal/sqlsplit"
+)
+
+// A Dialect selects the SQL syntax SplitStatements understands
+type Dialect int
+
+const (
+	// DialectPostgres understands dollar-quoted bodies, E'' strings, nested
+	// block comments and BEGIN ATOMIC function bodies
+	DialectPostgres Dialect = iota
+	// DialectSQLite understands `` and [] quoted identifiers and CREATE
+	// TRIGGER ... BEGIN ... END blocks
+	DialectSQLite
+)
+
+// A Statement is a single statement of a migration file
+type Statement struct {
+	// SQL is the statement without its terminating semicolon
+	SQL string
+	// Line is the 1-indexed line of the file the statement starts on
+	Line int
+}
+
+// SplitStatements splits a migration file into its statements, so they can
+// be run one at a time. Semicolons in strings, comments and block bodies do
+// not end a statement, and comments between statements are dropped.
+func SplitStatements(sql string, dialect Dialect) []Statement {
+	d := sqlsplit.Postgres
+	if dialect == DialectSQLite {
+		d = sqlsplit.SQLite
+	}
+
+	var statements []Statement
+	for _, st := range sqlsplit.Split(sql, d) {
+		statements = append(statements, Statement{
+			SQL:  strings.TrimRight(sql[st.Start:st.End], " \t\r\n"),
+			Line: st.Line,
+		})
+	}
+
+	return statements
+}
+
+// StatementError is returned when a statement of a migration fails, naming
+// the line of the file it starts on
+type StatementError struct {
+	Line int
+	SQL  string
+	Err  error
+}
+
+func (e *StatementError) Error() string {
+	summary := strings.TrimSpace(strings.SplitN(e.SQL, "\n", 2)[0])
+	if len(summary) > 60 {
+		summary = summary[:57] + "..."
+	}
+
+	return fmt.Sprintf("statement on line %d failed (%s): %s", e.Line, summary, e.Err)
+}
+
+func (e *StatementError) Unwrap() error {
+	return e.Err
+}
+
+// ExecStatements runs each statement of sql on db in turn, stopping at the
+// first that fails with a *StatementError
+func ExecStatements(ctx context.Context, db StdlibDB, sql string, dialect Dialect) error {
+	for _, st := range SplitStatements(sql, dialect) {
+		_, err := db.ExecContext(ctx, st.SQL)
+		if err != nil {
+			return &StatementError{Line: st.Line, SQL: st.SQL, Err: err}
+		}
+	}
+
+	return nil
+}
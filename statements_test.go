@@ -0,0 +1,64 @@
+package trek_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fortytw2/trek"
+)
+
+func TestSplitStatements(t *testing.T) {
+	cases := []struct {
+		name    string
+		sql     string
+		dialect trek.Dialect
+		want    []trek.Statement
+	}{
+		{
+			name: "strings and comments",
+			sql:  "-- header; not a statement\nINSERT INTO notes VALUES ('a;b', E'c\\';d');\n/* a; /* nested; */ comment */\nSELECT \"odd;name\" FROM t",
+			want: []trek.Statement{
+				{SQL: "INSERT INTO notes VALUES ('a;b', E'c\\';d')", Line: 2},
+				{SQL: "SELECT \"odd;name\" FROM t", Line: 4},
+			},
+		},
+		{
+			name: "dollar quoted function",
+			sql:  "CREATE FUNCTION f() RETURNS int AS $body$\nBEGIN\n  PERFORM 1;\n  RETURN $1;\nEND;\n$body$ LANGUAGE plpgsql;\nSELECT f();",
+			want: []trek.Statement{
+				{SQL: "CREATE FUNCTION f() RETURNS int AS $body$\nBEGIN\n  PERFORM 1;\n  RETURN $1;\nEND;\n$body$ LANGUAGE plpgsql", Line: 1},
+				{SQL: "SELECT f()", Line: 7},
+			},
+		},
+		{
+			name: "begin atomic function",
+			sql:  "CREATE FUNCTION g() RETURNS int LANGUAGE sql\nBEGIN ATOMIC\n  SELECT CASE WHEN true THEN 1 END;\nEND;\nSELECT g();",
+			want: []trek.Statement{
+				{SQL: "CREATE FUNCTION g() RETURNS int LANGUAGE sql\nBEGIN ATOMIC\n  SELECT CASE WHEN true THEN 1 END;\nEND", Line: 1},
+				{SQL: "SELECT g()", Line: 5},
+			},
+		},
+		{
+			name:    "sqlite trigger",
+			dialect: trek.DialectSQLite,
+			sql:     "CREATE TABLE [a;b] (id integer);\n\nCREATE TRIGGER t AFTER INSERT ON `a;b` BEGIN\n  UPDATE x SET y = CASE WHEN 1 THEN 2 END;\n  DELETE FROM z;\nEND;\n",
+			want: []trek.Statement{
+				{SQL: "CREATE TABLE [a;b] (id integer)", Line: 1},
+				{SQL: "CREATE TRIGGER t AFTER INSERT ON `a;b` BEGIN\n  UPDATE x SET y = CASE WHEN 1 THEN 2 END;\n  DELETE FROM z;\nEND", Line: 3},
+			},
+		},
+		{
+			name: "only comments",
+			sql:  "-- nothing to see\n/* here */\n",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := trek.SplitStatements(c.sql, c.dialect)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package trek
+
+import (
+	"context"
+	"errors"
+)
+
+// A StatusReport describes the migration state of a database
+type StatusReport struct {
+	// Applied is every migration in the history, in the order they sort
+	Applied []AppliedMigration
+	// Pending is every migration that has not been applied, in the order
+	// they would run
+	Pending []Migration
+	// Unknown is every applied migration without a matching migration
+	Unknown []AppliedMigration
+	// Modified is every applied migration whose SQL has changed since it
+	// was applied
+	Modified []ChecksumMismatch
+}
+
+// Status reports which migrations have been applied to db, which are pending
+// and which applied migrations no longer have a matching migration. It does
+// not take the migration lock. Templated migrations must be rendered with
+// RenderMigrations first.
+func Status(ctx context.Context, db MigratableDB, allMigrations []Migration) (*StatusReport, error) {
+	applied, err := db.AppliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetStatus(allMigrations, applied), nil
+}
+
+// GetStatus builds a StatusReport from an applied migration history
+func GetStatus(migrations []Migration, applied []AppliedMigration) *StatusReport {
+	// entries recorded under an alias are renamed on the next migration,
+	// report them under their current name
+	renames, err := GetRenames(migrations, applied)
+	if err == nil {
+		applied = ApplyRenames(applied, renames)
+	}
+
+	// baselines are recorded on the next migration once everything they
+	// replace has been applied
+	replacing, err := GetReplacingMigrations(migrations, applied)
+	if err == nil {
+		applied = ApplyReplacing(applied, replacing)
+	}
+
+	known := make(map[string]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Name] = true
+		for _, replaced := range m.Replaces {
+			known[replaced] = true
+		}
+	}
+
+	report := &StatusReport{
+		Applied: applied,
+	}
+
+	for _, a := range applied {
+		if !known[a.Name] {
+			report.Unknown = append(report.Unknown, a)
+		}
+	}
+
+	// cannot fail when out of order migrations are allowed
+	report.Pending, _ = GetPendingMigrations(migrations, applied, true)
+
+	var mismatchErr *ChecksumMismatchError
+	if errors.As(VerifyChecksums(migrations, applied), &mismatchErr) {
+		report.Modified = mismatchErr.Mismatches
+	}
+
+	return report
+}
@@ -0,0 +1,65 @@
+package trek
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// RenderMigrations renders the SQL and DownSQL of every migration as a
+// text/template with data, so schema names, roles or tablespaces can vary
+// between environments
+//
+//	GRANT SELECT ON monkeys TO {{ .ReadOnlyRole }};
+//
+// Checksums are taken from the rendered SQL, so changing data for an
+// environment after migrating it is reported as drift. Referencing a value
+// missing from data is an error naming the migration.
+func RenderMigrations(migrations []Migration, data interface{}) ([]Migration, error) {
+	out := make([]Migration, 0, len(migrations))
+	for _, m := range migrations {
+		var err error
+		m.SQL, err = renderSQL(m.Name, m.SQL, data)
+		if err != nil {
+			return nil, err
+		}
+
+		m.DownSQL, err = renderSQL(m.Name, m.DownSQL, data)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, m)
+	}
+
+	return out, nil
+}
+
+func renderSQL(name, sql string, data interface{}) (string, error) {
+	if sql == "" {
+		return sql, nil
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(sql)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse migration %s as a template: %w", name, err)
+	}
+
+	var sb strings.Builder
+	err = tmpl.Execute(&sb, data)
+	if err != nil {
+		return "", fmt.Errorf("cannot render migration %s: %w", name, err)
+	}
+
+	return sb.String(), nil
+}
+
+// prepareMigrations applies the options that change migrations before they
+// are handed to a MigratableDB
+func prepareMigrations(migrations []Migration, o MigrateOptions) ([]Migration, error) {
+	if o.TemplateData == nil {
+		return migrations, nil
+	}
+
+	return RenderMigrations(migrations, o.TemplateData)
+}
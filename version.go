@@ -0,0 +1,212 @@
+package trek
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Version is the numeric prefix of a migration name, either a sequence
+// number such as 01_init.sql, a timestamp such as 20220131120000_init.sql or
+// an underscore separated date such as 2022_01_31_init.sql
+type Version struct {
+	Number      uint64
+	Description string
+}
+
+// ParseVersion splits the file name of a migration into its version and
+// description, 01_add_users.sql has version 1 and description add_users.
+// Repeatable migrations and names without a numeric prefix have no version.
+//
+// A YYYY_MM_DD prefix, optionally followed by _HH_MM or _HH_MM_SS, is read as
+// a date and has the version of the equivalent timestamp, so
+// 2022_01_31_create_users.sql has version 20220131000000. Any other prefix
+// ends at its first non digit, 0012_10_percent.sql has version 12.
+func ParseVersion(name string) (Version, error) {
+	base := path.Base(name)
+	base = strings.TrimSuffix(base, path.Ext(base))
+
+	number, digits, ok := parseDate(base)
+	if !ok {
+		digits = leadingDigits(base)
+		number = base[:digits]
+	}
+
+	if digits == 0 {
+		return Version{}, fmt.Errorf("migration %s has no version prefix", name)
+	}
+
+	if digits < len(base) && base[digits] != '_' && base[digits] != '-' {
+		return Version{}, fmt.Errorf("migration %s version must be followed by _ or -", name)
+	}
+
+	n, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return Version{}, fmt.Errorf("migration %s has an invalid version: %w", name, err)
+	}
+
+	v := Version{Number: n}
+	if digits < len(base) {
+		v.Description = base[digits+1:]
+	}
+
+	return v, nil
+}
+
+// dateFields are the ranges of the two digit fields following the year of a
+// date prefix: month, day, hour, minute and second
+var dateFields = []struct{ min, max int }{{1, 12}, {1, 31}, {0, 23}, {0, 59}, {0, 59}}
+
+// parseDate reads a YYYY_MM_DD[_HH_MM[_SS]] prefix of base as a 14 digit
+// timestamp, returning the timestamp and the length of the prefix
+func parseDate(base string) (string, int, bool) {
+	if leadingDigits(base) != 4 {
+		return "", 0, false
+	}
+
+	year, _ := strconv.Atoi(base[:4])
+	if year < 1900 || year > 2999 {
+		return "", 0, false
+	}
+
+	number, length := base[:4], 4
+	var fields int
+	for fields < len(dateFields) {
+		if length+3 > len(base) || base[length] != '_' || leadingDigits(base[length+1:]) != 2 {
+			break
+		}
+
+		field := base[length+1 : length+3]
+		value, _ := strconv.Atoi(field)
+		if value < dateFields[fields].min || value > dateFields[fields].max {
+			break
+		}
+
+		number += field
+		length += 3
+		fields++
+	}
+
+	switch fields {
+	case 0, 1:
+		return "", 0, false
+	case 3:
+		// an hour without minutes is part of the description
+		number, length = number[:8], 10
+	}
+
+	return number + strings.Repeat("0", 14-len(number)), length, true
+}
+
+func leadingDigits(s string) int {
+	digits := 0
+	for digits < len(s) && s[digits] >= '0' && s[digits] <= '9' {
+		digits++
+	}
+
+	return digits
+}
+
+// CompareNames orders migration names by version, so 9_b.sql runs before
+// 10_a.sql. Names sharing a version, such as a Go migration placed between two
+// files, are ordered by name, and names without a version sort after every
+// versioned name. It returns -1, 0 or +1.
+func CompareNames(a, b string) int {
+	va, errA := ParseVersion(a)
+	vb, errB := ParseVersion(b)
+
+	switch {
+	case errA == nil && errB != nil:
+		return -1
+	case errA != nil && errB == nil:
+		return 1
+	case errA == nil && va.Number != vb.Number:
+		if va.Number < vb.Number {
+			return -1
+		}
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
+
+// checkDuplicateVersions returns an error if two versioned migrations in the
+// same directory share a version, as happens when two branches both add the
+// next migration
+func checkDuplicateVersions(migrations []Migration) error {
+	type key struct {
+		dir    string
+		number uint64
+	}
+
+	seen := make(map[key]string)
+	for _, m := range migrations {
+		if m.Repeatable {
+			continue
+		}
+
+		v, err := ParseVersion(m.Name)
+		if err != nil {
+			continue
+		}
+
+		k := key{dir: path.Dir(m.Name), number: v.Number}
+		if other, ok := seen[k]; ok {
+			return fmt.Errorf("duplicate migration version %d: %s and %s", v.Number, other, m.Name)
+		}
+		seen[k] = m.Name
+	}
+
+	return nil
+}
+
+// VerifyVersions returns an error if a migration that has not been applied
+// shares its version with an applied migration that no longer exists, as
+// happens when an applied file is renamed or a branch reuses a version that
+// was already applied elsewhere
+func VerifyVersions(migrations []Migration, applied []AppliedMigration) error {
+	type key struct {
+		dir    string
+		number uint64
+	}
+
+	known := make(map[string]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Name] = true
+		for _, replaced := range m.Replaces {
+			known[replaced] = true
+		}
+	}
+
+	unknown := make(map[key]string)
+	for _, a := range applied {
+		v, err := ParseVersion(a.Name)
+		if err != nil || known[a.Name] || IsRepeatableName(a.Name) {
+			continue
+		}
+		unknown[key{dir: path.Dir(a.Name), number: v.Number}] = a.Name
+	}
+
+	for _, m := range migrations {
+		v, err := ParseVersion(m.Name)
+		if err != nil || m.Repeatable {
+			continue
+		}
+
+		if other, ok := unknown[key{dir: path.Dir(m.Name), number: v.Number}]; ok {
+			return fmt.Errorf("migration %s has the same version as applied migration %s, which no longer exists", m.Name, other)
+		}
+	}
+
+	return nil
+}
+
+// SortAppliedMigrations orders an applied migration history the way
+// migrations are ordered, see CompareNames
+func SortAppliedMigrations(applied []AppliedMigration) {
+	sort.SliceStable(applied, func(i, j int) bool {
+		return CompareNames(applied[i].Name, applied[j].Name) < 0
+	})
+}
@@ -0,0 +1,143 @@
+package trek_test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/fortytw2/trek"
+)
+
+func TestParseVersion(t *testing.T) {
+	cases := []struct {
+		name        string
+		number      uint64
+		description string
+		err         bool
+	}{
+		{name: "schema/01_add_users.sql", number: 1, description: "add_users"},
+		{name: "20220131120000-init.sql", number: 20220131120000, description: "init"},
+		{name: "schema/02_backfill.go", number: 2, description: "backfill"},
+		{name: "7.sql", number: 7},
+		{name: "2022_01_31_create_users.sql", number: 20220131000000, description: "create_users"},
+		{name: "2022_02_14_09_30_add_index.sql", number: 20220214093000, description: "add_index"},
+		{name: "2022_02_14_09_30_15_add_index.sql", number: 20220214093015, description: "add_index"},
+		{name: "2022_01_31_10_users.sql", number: 20220131000000, description: "10_users"},
+		{name: "0012_10_percent_discount.sql", number: 12, description: "10_percent_discount"},
+		{name: "2022_13_01_x.sql", number: 2022, description: "13_01_x"},
+		{name: "2022_1_fix.sql", number: 2022, description: "1_fix"},
+		{name: "01_02_x.sql", number: 1, description: "02_x"},
+		{name: "R__views.sql", err: true},
+		{name: "init.sql", err: true},
+		{name: "1a_init.sql", err: true},
+	}
+
+	for _, c := range cases {
+		v, err := trek.ParseVersion(c.name)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want error %v", c.name, err, c.err)
+			continue
+		}
+
+		if v.Number != c.number || v.Description != c.description {
+			t.Errorf("%s: got %+v, want %d %q", c.name, v, c.number, c.description)
+		}
+	}
+}
+
+func TestCompareNames(t *testing.T) {
+	names := []string{"init.sql", "10_x.sql", "9_y.sql", "02_b.go", "02_a.sql", "100_z.sql"}
+	sort.Slice(names, func(i, j int) bool {
+		return trek.CompareNames(names[i], names[j]) < 0
+	})
+
+	want := "02_a.sql 02_b.go 9_y.sql 10_x.sql 100_z.sql init.sql"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestCompareDateNames(t *testing.T) {
+	cases := []struct{ before, after string }{
+		{"0012_10_percent_discount.sql", "0013_add_users.sql"},
+		{"2022_01_31_10_users.sql", "2022_12_31_x.sql"},
+		{"2022_01_31_x.sql", "2022_01_31_09_30_y.sql"},
+		{"2022_01_31_09_30_y.sql", "20220131120000_z.sql"},
+	}
+
+	for _, c := range cases {
+		if trek.CompareNames(c.before, c.after) >= 0 || trek.CompareNames(c.after, c.before) <= 0 {
+			t.Errorf("%s does not sort before %s", c.before, c.after)
+		}
+	}
+}
+
+func TestGetMigrationsVersionOrder(t *testing.T) {
+	migrations, err := trek.GetMigrations(fstest.MapFS{
+		"10_x.sql":    {Data: []byte("SELECT 10;")},
+		"9_y.sql":     {Data: []byte("SELECT 9;")},
+		"R__view.sql": {Data: []byte("SELECT 0;")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, m := range migrations {
+		names = append(names, m.Name)
+	}
+
+	want := "9_y.sql 10_x.sql R__view.sql"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestGetMigrationsDuplicateVersion(t *testing.T) {
+	_, err := trek.GetMigrations(fstest.MapFS{
+		"05_add_users.sql": {Data: []byte("SELECT 1;")},
+		"5_add_posts.sql":  {Data: []byte("SELECT 2;")},
+	})
+	if err == nil || !strings.Contains(err.Error(), "duplicate migration version 5") {
+		t.Errorf("got %v, want a duplicate version error", err)
+	}
+}
+
+func TestGetMigrationsDateVersions(t *testing.T) {
+	migrations, err := trek.GetMigrations(fstest.MapFS{
+		"2022_02_14_add_index.sql":    {Data: []byte("SELECT 2;")},
+		"2022_01_31_create_users.sql": {Data: []byte("SELECT 1;")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, m := range migrations {
+		names = append(names, m.Name)
+	}
+
+	want := "2022_01_31_create_users.sql 2022_02_14_add_index.sql"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestVerifyVersions(t *testing.T) {
+	migrations := []trek.Migration{
+		{Name: "01_init.sql"},
+		{Name: "02_add_posts.sql"},
+	}
+
+	applied := []trek.AppliedMigration{{Name: "01_init.sql"}, {Name: "02_add_users.sql"}}
+	err := trek.VerifyVersions(migrations, applied)
+	if err == nil || !strings.Contains(err.Error(), "02_add_users.sql") {
+		t.Errorf("got %v, want a version conflict with 02_add_users.sql", err)
+	}
+
+	applied = []trek.AppliedMigration{{Name: "01_init.sql"}, {Name: "02_add_posts.sql"}}
+	if err := trek.VerifyVersions(migrations, applied); err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+}